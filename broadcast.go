@@ -0,0 +1,109 @@
+package kim
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultPushConcurrency Broadcast与PushMany同时推送的goroutine数
+const DefaultPushConcurrency = 32
+
+// ErrChannelNotFound PushMany中的channelId不在线
+var ErrChannelNotFound = errors.New("channel not found")
+
+// PushReport 批量推送的结果
+type PushReport struct {
+	Total   int              // 需要推送的目标数，包括不在线的id
+	Success int              // 成功放入发送队列的目标数
+	Errors  map[string]error // 推送失败的channelId及原因
+}
+
+// Err 返回任意一个推送失败的原因，全部成功时返回nil
+func (r *PushReport) Err() error {
+	for _, err := range r.Errors {
+		return err
+	}
+	return nil
+}
+
+// BroadcastChannels 把payload推送到channels中所有满足filters的连接。
+// payload只会按每种协议编码一次，编码结果在所有目标之间共享；
+// 发送队列已满的连接不会被等待，记为ErrWriteQueueFull
+func BroadcastChannels(channels ChannelMap, payload []byte, concurrency int, filters ...DeviceFilter) *PushReport {
+	list := make([]Channel, 0, channels.Len())
+	channels.Range(func(ch Channel) bool {
+		if match(ch.Session(), filters) {
+			list = append(list, ch)
+		}
+		return true
+	})
+	report := &PushReport{Errors: make(map[string]error)}
+	pushChannels(report, list, payload, concurrency)
+	return report
+}
+
+// PushChannels 把payload推送到ids中满足filters的连接，不在线的id记为ErrChannelNotFound
+func PushChannels(channels ChannelMap, ids []string, payload []byte, concurrency int, filters ...DeviceFilter) *PushReport {
+	report := &PushReport{Errors: make(map[string]error)}
+	list := make([]Channel, 0, len(ids))
+	for _, id := range ids {
+		ch, ok := channels.Get(id)
+		if !ok {
+			report.Total++
+			report.Errors[id] = ErrChannelNotFound
+			continue
+		}
+		if match(ch.Session(), filters) {
+			list = append(list, ch)
+		}
+	}
+	pushChannels(report, list, payload, concurrency)
+	return report
+}
+
+// pushChannels 把list分成最多concurrency段，每段由一个goroutine依次TryPush。
+// TryPush不会阻塞，一个卡住的连接不会拖慢其它目标
+func pushChannels(report *PushReport, list []Channel, payload []byte, concurrency int) {
+	report.Total += len(list)
+	if len(list) == 0 {
+		return
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultPushConcurrency
+	}
+	size := (len(list) + concurrency - 1) / concurrency
+	frame := NewPreparedFrame(payload)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for start := 0; start < len(list); start += size {
+		end := start + size
+		if end > len(list) {
+			end = len(list)
+		}
+		wg.Add(1)
+		go func(part []Channel) {
+			defer wg.Done()
+			success := 0
+			var errs map[string]error
+			for _, ch := range part {
+				if err := ch.TryPush(frame); err != nil {
+					if errs == nil {
+						errs = make(map[string]error)
+					}
+					errs[ch.ID()] = err
+					continue
+				}
+				success++
+			}
+			mu.Lock()
+			report.Success += success
+			for id, err := range errs {
+				report.Errors[id] = err
+			}
+			mu.Unlock()
+		}(list[start:end])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,112 @@
+package kim
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowChannel 的发送队列一直是满的，Push会阻塞
+type slowChannel struct {
+	*deviceChannel
+	release chan struct{}
+}
+
+func (c *slowChannel) Push(payload []byte) error {
+	<-c.release
+	return errors.New("write timeout")
+}
+
+func (c *slowChannel) TryPush(frame *PreparedFrame) error {
+	return ErrWriteQueueFull
+}
+
+func TestBroadcastChannels(t *testing.T) {
+	channels := NewChannels(10)
+	phone := newDevice("c1", "u1", "d1", "ios")
+	web := newDevice("c2", "u2", "d2", "web")
+	channels.Add(phone)
+	channels.Add(web)
+
+	payload := []byte("hello")
+	report := BroadcastChannels(channels, payload, 0)
+	if report.Total != 2 || report.Success != 2 || report.Err() != nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// 所有目标共享同一个payload
+	if &phone.pushed[0][0] != &payload[0] || &web.pushed[0][0] != &payload[0] {
+		t.Fatal("payload should not be copied")
+	}
+
+	report = BroadcastChannels(channels, payload, 0, DeviceTypes("web"))
+	if report.Total != 1 || len(phone.pushed) != 1 || len(web.pushed) != 2 {
+		t.Fatalf("only web should receive the message, report %+v", report)
+	}
+}
+
+func TestPushChannels(t *testing.T) {
+	channels := NewChannels(10)
+	phone := newDevice("c1", "u1", "d1", "ios")
+	channels.Add(phone)
+
+	report := PushChannels(channels, []string{"c1", "c404"}, []byte("hello"), 0)
+	if report.Total != 2 || report.Success != 1 || report.Errors["c404"] != ErrChannelNotFound {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	report = PushChannels(channels, []string{"c1"}, []byte("hello"), 0, ExceptDevice("d1"))
+	if report.Total != 0 || len(phone.pushed) != 1 {
+		t.Fatalf("d1 should be excluded, report %+v", report)
+	}
+}
+
+func TestPushChannelsSlowChannel(t *testing.T) {
+	channels := NewChannels(10)
+	slow := &slowChannel{deviceChannel: newDevice("slow", "u0", "d0", "pc"), release: make(chan struct{})}
+	channels.Add(slow)
+	fast := make([]*deviceChannel, 10)
+	ids := []string{"slow"}
+	for i := range fast {
+		fast[i] = newDevice(string(rune('a'+i)), "u1", "d1", "ios")
+		channels.Add(fast[i])
+		ids = append(ids, fast[i].ID())
+	}
+
+	defer close(slow.release)
+
+	done := make(chan *PushReport)
+	go func() {
+		done <- PushChannels(channels, ids, []byte("hello"), 2)
+	}()
+	// 队列已满的连接不会被等待，其它的连接照常推送
+	var report *PushReport
+	select {
+	case report = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a slow channel stalls the others")
+	}
+	for _, ch := range fast {
+		if ch.count() != 1 {
+			t.Fatalf("%s has %d messages, want 1", ch.ID(), ch.count())
+		}
+	}
+	if report.Total != 11 || report.Success != 10 || !errors.Is(report.Errors["slow"], ErrWriteQueueFull) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestPreparedFrameEncodeOnce(t *testing.T) {
+	frame := NewPreparedFrame([]byte("hello"))
+	calls := 0
+	encode := func(payload []byte) ([]byte, error) {
+		calls++
+		return append([]byte{byte(calls)}, payload...), nil
+	}
+	a, _ := frame.Encode("v0", encode)
+	b, _ := frame.Encode("v0", encode)
+	if calls != 1 || &a[0] != &b[0] {
+		t.Fatalf("same key should be encoded once, calls %d", calls)
+	}
+	if c, _ := frame.Encode("v1", encode); calls != 2 || c[0] != 2 {
+		t.Fatalf("another key should be encoded again, calls %d", calls)
+	}
+}
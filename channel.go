@@ -1,12 +1,16 @@
 package kim
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/wire"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 // ChannelImpl is a websocket implement of channel
@@ -14,11 +18,15 @@ type ChannelImpl struct {
 	sync.Mutex
 	id string
 	Conn
-	writechan chan []byte
-	once      sync.Once
+	wlock     sync.Mutex   // 保证writeloop与直接写控制帧之间互斥
+	plock     sync.RWMutex // 保证关闭writechan之后不再Push
+	stopped   bool         // 不再接收新的消息
+	writechan chan message
+	writeDone *Event // writeloop已经退出
 	writeWait time.Duration
 	readwait  time.Duration
 	closed    *Event
+	session   *Session
 }
 
 // NewChannel NewChannel
@@ -30,12 +38,15 @@ func NewChannel(id string, conn Conn) Channel {
 	ch := &ChannelImpl{
 		id:        id,
 		Conn:      conn,
-		writechan: make(chan []byte, 5),
+		writechan: make(chan message, 5),
+		writeDone: NewEvent(),
 		closed:    NewEvent(),
+		session:   &Session{ChannelID: id},
 		writeWait: DefaultWriteWait, //default value
 		readwait:  DefaultReadWait,
 	}
 	go func() {
+		defer ch.writeDone.Fire()
 		err := ch.writeloop()
 		if err != nil {
 			log.Info(err)
@@ -44,24 +55,15 @@ func NewChannel(id string, conn Conn) Channel {
 	return ch
 }
 
+// writeloop writechan关闭之后，把其中剩余的消息写完再退出
 func (ch *ChannelImpl) writeloop() error {
 	for {
 		select {
-		case payload := <-ch.writechan:
-			err := ch.WriteFrame(OpBinary, payload)
-			if err != nil {
-				return err
-			}
-			chanlen := len(ch.writechan)
-			for i := 0; i < chanlen; i++ {
-				payload = <-ch.writechan
-				err := ch.WriteFrame(OpBinary, payload)
-				if err != nil {
-					return err
-				}
+		case msg, ok := <-ch.writechan:
+			if !ok {
+				return nil
 			}
-			err = ch.Conn.Flush()
-			if err != nil {
+			if err := ch.writeBatch(msg); err != nil {
 				return err
 			}
 		case <-ch.closed.Done():
@@ -70,34 +72,123 @@ func (ch *ChannelImpl) writeloop() error {
 	}
 }
 
+// writeBatch 把msg与队列中已有的消息一起写入缓冲区，最后只Flush一次
+func (ch *ChannelImpl) writeBatch(msg message) error {
+	ch.wlock.Lock()
+	defer ch.wlock.Unlock()
+	_ = ch.Conn.SetWriteDeadline(time.Now().Add(ch.writeWait))
+
+	err := writeMessage(ch.Conn, msg)
+	if err != nil {
+		return err
+	}
+	chanlen := len(ch.writechan)
+	for i := 0; i < chanlen; i++ {
+		msg, ok := <-ch.writechan
+		if !ok {
+			break
+		}
+		err := writeMessage(ch.Conn, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return ch.Conn.Flush()
+}
+
 // ID id
 func (ch *ChannelImpl) ID() string { return ch.id }
 
-// Send 异步写数据
+// Push 异步写数据
 func (ch *ChannelImpl) Push(payload []byte) error {
-	if ch.closed.HasFired() {
+	ch.plock.RLock()
+	defer ch.plock.RUnlock()
+	if ch.stopped {
 		return fmt.Errorf("channel %s has closed", ch.id)
 	}
 	// 异步写
-	ch.writechan <- payload
-	return nil
+	select {
+	case ch.writechan <- message{payload: payload}:
+		return nil
+	case <-ch.writeDone.Done():
+		return fmt.Errorf("channel %s writeloop has exited", ch.id)
+	}
 }
 
-// overwrite Conn
+// TryPush 异步写一个预先编码的帧，发送队列已满时返回ErrWriteQueueFull而不是等待
+func (ch *ChannelImpl) TryPush(frame *PreparedFrame) error {
+	ch.plock.RLock()
+	defer ch.plock.RUnlock()
+	if ch.stopped {
+		return fmt.Errorf("channel %s has closed", ch.id)
+	}
+	select {
+	case ch.writechan <- message{prepared: frame}:
+		return nil
+	case <-ch.writeDone.Done():
+		return fmt.Errorf("channel %s writeloop has exited", ch.id)
+	default:
+		return fmt.Errorf("channel %s: %w", ch.id, ErrWriteQueueFull)
+	}
+}
+
+// WriteFrame overwrite Conn，直接写一个帧并立即Flush
 func (ch *ChannelImpl) WriteFrame(code OpCode, payload []byte) error {
+	ch.wlock.Lock()
+	defer ch.wlock.Unlock()
 	_ = ch.Conn.SetWriteDeadline(time.Now().Add(ch.writeWait))
-	return ch.Conn.WriteFrame(code, payload)
+	if err := ch.Conn.WriteFrame(code, payload); err != nil {
+		return err
+	}
+	return ch.Conn.Flush()
 }
 
-// Close 关闭连接
-func (ch *ChannelImpl) Close() error {
-	ch.once.Do(func() {
+// stop 不再接收新的消息，writeloop写完剩余的消息之后退出
+func (ch *ChannelImpl) stop() {
+	ch.plock.Lock()
+	defer ch.plock.Unlock()
+	if !ch.stopped {
+		ch.stopped = true
 		close(ch.writechan)
-		ch.closed.Fire()
-	})
+	}
+}
+
+// Close 关闭连接，writechan中还没有写出的消息会被丢弃
+func (ch *ChannelImpl) Close() error {
+	ch.stop()
+	if ch.closed.Fire() {
+		return ch.Conn.Close()
+	}
 	return nil
 }
 
+// Shutdown 优雅地关闭连接：不再接收新的消息，把writechan中的消息写完之后，
+// 发送一个带有reason的OpClose帧再关闭连接。ctx到期时放弃剩余的消息
+func (ch *ChannelImpl) Shutdown(ctx context.Context, reason string) error {
+	ch.stop()
+	var err error
+	select {
+	case <-ch.writeDone.Done():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = ch.WriteFrame(OpClose, []byte(reason))
+	_ = ch.Close()
+	return err
+}
+
+// Session 握手时Acceptor返回的会话信息，没有设置时只有ChannelID
+func (ch *ChannelImpl) Session() *Session {
+	return ch.session
+}
+
+// SetSession 设置会话信息，需要在加入ChannelMap之前调用
+func (ch *ChannelImpl) SetSession(session *Session) {
+	if session != nil {
+		ch.session = session
+	}
+}
+
 // SetWriteWait 设置写超时
 func (ch *ChannelImpl) SetWriteWait(writeWait time.Duration) {
 	if writeWait == 0 {
@@ -110,37 +201,60 @@ func (ch *ChannelImpl) SetReadWait(readwait time.Duration) {
 	if readwait == 0 {
 		return
 	}
-	ch.writeWait = readwait
+	ch.readwait = readwait
 }
 
 func (ch *ChannelImpl) Readloop(lst MessageListener) error {
 	ch.Lock()
 	defer ch.Unlock()
-	log := logger.WithFields(logger.Fields{
-		"struct": "ChannelImpl",
-		"func":   "Readloop",
-		"id":     ch.id,
-	})
 	for {
 		_ = ch.SetReadDeadline(time.Now().Add(ch.readwait))
 
 		frame, err := ch.ReadFrame()
 		if err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				_ = ch.WriteFrame(OpClose, []byte(err.Error()))
+			}
 			return err
 		}
-		if frame.GetOpCode() == OpClose {
-			return errors.New("remote side close the channel")
-		}
-		if frame.GetOpCode() == OpPing {
-			log.Trace("recv a ping; resp with a pong")
-			_ = ch.WriteFrame(OpPong, nil)
-			continue
-		}
-		payload := frame.GetPayload()
-		if len(payload) == 0 {
-			continue
+		if err = dispatch(ch, frame, lst); err != nil {
+			return err
 		}
-		// TODO: Optimization point
-		go lst.Receive(ch, payload)
+	}
+}
+
+// dispatch 处理读取到的一个帧，控制帧与基础消息包在通道内处理，
+// 其它消息交给业务层。返回error时需要关闭连接
+func dispatch(ch Channel, frame Frame, lst MessageListener) error {
+	if frame.GetOpCode() == OpClose {
+		return errors.New("remote side close the channel")
+	}
+	if frame.GetOpCode() == OpPing {
+		logger.WithField("id", ch.ID()).Trace("recv a ping; resp with a pong")
+		_ = ch.WriteFrame(OpPong, nil)
+		return nil
+	}
+	payload := frame.GetPayload()
+	if len(payload) == 0 {
+		return nil
+	}
+	// 基础消息包(如应用层心跳)直接在通道内处理，不再交给业务层
+	if bytes.HasPrefix(payload, wire.MagicBasicPkt[:]) {
+		handleBasicPkt(ch, payload)
+		return nil
+	}
+	// TODO: Optimization point
+	go lst.Receive(ch, payload)
+	return nil
+}
+
+func handleBasicPkt(ch Channel, payload []byte) {
+	basic, err := pkt.MustReadBasicPkt(bytes.NewReader(payload))
+	if err != nil {
+		logger.WithField("id", ch.ID()).Warn(err)
+		return
+	}
+	if basic.Code == pkt.CodePing {
+		_ = ch.Push(pkt.Marshal(&pkt.BasicPkt{Code: pkt.CodePong}))
 	}
 }
@@ -0,0 +1,241 @@
+package kim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPollQueueSize PollChannel中等待写出的消息的最大数量
+const DefaultPollQueueSize = 1024
+
+// PollChannel 是一个没有常驻协程的Channel，用于netpoll模式：
+// 连接可读时由调用方执行ReadOnce，Push时按需启动写协程，队列写空之后协程退出。
+// 相比ChannelImpl，一个空闲的连接不再占用readloop与writeloop两个协程的栈
+type PollChannel struct {
+	id string
+	Conn
+	wlock     sync.Mutex // 保证写协程与直接写控制帧之间互斥
+	mu        sync.Mutex
+	queue     []message
+	writing   bool
+	stopped   bool          // 不再接收新的消息
+	drained   chan struct{} // Shutdown等待写协程把队列写完
+	writeWait time.Duration
+	readwait  time.Duration
+	closed    *Event
+	session   *Session
+	onClose   func() // Close时的回调，由mu保护
+}
+
+// NewPollChannel NewPollChannel
+func NewPollChannel(id string, conn Conn) *PollChannel {
+	return &PollChannel{
+		id:        id,
+		Conn:      conn,
+		closed:    NewEvent(),
+		session:   &Session{ChannelID: id},
+		writeWait: DefaultWriteWait,
+		readwait:  DefaultReadWait,
+	}
+}
+
+// ID id
+func (ch *PollChannel) ID() string { return ch.id }
+
+// Push 异步写数据，队列满时返回ErrWriteQueueFull而不是阻塞
+func (ch *PollChannel) Push(payload []byte) error {
+	return ch.push(message{payload: payload})
+}
+
+// TryPush 与Push相同，PollChannel的Push本身不会阻塞
+func (ch *PollChannel) TryPush(frame *PreparedFrame) error {
+	return ch.push(message{prepared: frame})
+}
+
+func (ch *PollChannel) push(msg message) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.stopped || ch.closed.HasFired() {
+		return fmt.Errorf("channel %s has closed", ch.id)
+	}
+	if len(ch.queue) >= DefaultPollQueueSize {
+		return fmt.Errorf("channel %s: %w", ch.id, ErrWriteQueueFull)
+	}
+	ch.queue = append(ch.queue, msg)
+	if !ch.writing {
+		ch.writing = true
+		go ch.writeloop()
+	}
+	return nil
+}
+
+// writeloop 把队列中的消息一次写出并Flush，直到队列为空
+func (ch *PollChannel) writeloop() {
+	for {
+		ch.mu.Lock()
+		batch := ch.queue
+		ch.queue = nil
+		if len(batch) == 0 || ch.closed.HasFired() {
+			ch.writeExited()
+			ch.mu.Unlock()
+			return
+		}
+		ch.mu.Unlock()
+
+		if err := ch.writeBatch(batch); err != nil {
+			ch.mu.Lock()
+			ch.queue = nil
+			ch.writeExited()
+			ch.mu.Unlock()
+			return
+		}
+	}
+}
+
+// writeExited 需要持有mu
+func (ch *PollChannel) writeExited() {
+	ch.writing = false
+	if ch.drained != nil {
+		close(ch.drained)
+		ch.drained = nil
+	}
+}
+
+func (ch *PollChannel) writeBatch(batch []message) error {
+	ch.wlock.Lock()
+	defer ch.wlock.Unlock()
+	_ = ch.Conn.SetWriteDeadline(time.Now().Add(ch.writeWait))
+	for _, msg := range batch {
+		if err := writeMessage(ch.Conn, msg); err != nil {
+			return err
+		}
+	}
+	return ch.Conn.Flush()
+}
+
+// WriteFrame overwrite Conn，直接写一个帧并立即Flush
+func (ch *PollChannel) WriteFrame(code OpCode, payload []byte) error {
+	ch.wlock.Lock()
+	defer ch.wlock.Unlock()
+	_ = ch.Conn.SetWriteDeadline(time.Now().Add(ch.writeWait))
+	if err := ch.Conn.WriteFrame(code, payload); err != nil {
+		return err
+	}
+	return ch.Conn.Flush()
+}
+
+// ReadOnce 读取并处理一个帧，在连接可读时调用。返回error时需要关闭连接
+func (ch *PollChannel) ReadOnce(lst MessageListener, timeout time.Duration) error {
+	_ = ch.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := ch.ReadFrame()
+	if err != nil {
+		if errors.Is(err, ErrFrameTooLarge) {
+			_ = ch.WriteFrame(OpClose, []byte(err.Error()))
+		}
+		return err
+	}
+	return ch.Dispatch(lst, frame)
+}
+
+// Dispatch 处理一个完整的帧，用于调用方自己非阻塞地读取并解析帧的场景。返回error时需要关闭连接
+func (ch *PollChannel) Dispatch(lst MessageListener, frame Frame) error {
+	return dispatch(ch, frame, lst)
+}
+
+// Readloop 与ChannelImpl相同，阻塞读取直到连接断开，用于没有netpoll的场景
+func (ch *PollChannel) Readloop(lst MessageListener) error {
+	for {
+		if err := ch.ReadOnce(lst, ch.readwait); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadWait 读超时，netpoll模式下超过该时间没有可读数据时关闭连接
+func (ch *PollChannel) ReadWait() time.Duration {
+	return ch.readwait
+}
+
+// Close 关闭连接，队列中还没有写出的消息会被丢弃。
+// 设置了OnClose时，先回调它再关闭底层的连接
+func (ch *PollChannel) Close() error {
+	if ch.closed.Fire() {
+		ch.mu.Lock()
+		onClose := ch.onClose
+		ch.mu.Unlock()
+		if onClose != nil {
+			onClose()
+		}
+		return ch.Conn.Close()
+	}
+	return nil
+}
+
+// OnClose 设置Close时的回调，netpoll用它在Kick等外部关闭时注销连接。
+// 已经关闭时立即回调，f可能被调用多次，需要是幂等的
+func (ch *PollChannel) OnClose(f func()) {
+	ch.mu.Lock()
+	ch.onClose = f
+	closed := ch.closed.HasFired()
+	ch.mu.Unlock()
+	if closed {
+		f()
+	}
+}
+
+// Shutdown 与ChannelImpl相同，等待写协程把队列写完之后发送OpClose帧并关闭连接
+func (ch *PollChannel) Shutdown(ctx context.Context, reason string) error {
+	ch.mu.Lock()
+	ch.stopped = true
+	var drained chan struct{}
+	if ch.writing {
+		if ch.drained == nil {
+			ch.drained = make(chan struct{})
+		}
+		drained = ch.drained
+	}
+	ch.mu.Unlock()
+
+	var err error
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	_ = ch.WriteFrame(OpClose, []byte(reason))
+	_ = ch.Close()
+	return err
+}
+
+// Session 握手时Acceptor返回的会话信息，没有设置时只有ChannelID
+func (ch *PollChannel) Session() *Session {
+	return ch.session
+}
+
+// SetSession 设置会话信息，需要在加入ChannelMap之前调用
+func (ch *PollChannel) SetSession(session *Session) {
+	if session != nil {
+		ch.session = session
+	}
+}
+
+// SetWriteWait 设置写超时
+func (ch *PollChannel) SetWriteWait(writeWait time.Duration) {
+	if writeWait == 0 {
+		return
+	}
+	ch.writeWait = writeWait
+}
+
+// SetReadWait 设置读超时
+func (ch *PollChannel) SetReadWait(readwait time.Duration) {
+	if readwait == 0 {
+		return
+	}
+	ch.readwait = readwait
+}
@@ -1,7 +1,9 @@
 package kim
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sunrnalike/sun/logger"
 )
@@ -12,21 +14,94 @@ type ChannelMap interface {
 	Remove(id string)
 	Get(id string) (channel Channel, ok bool)
 	All() []Channel
+	// Len 返回Channel的数量
+	Len() int
+	// Range 遍历所有的Channel，f返回false时停止。f中不能修改这个ChannelMap
+	Range(f func(Channel) bool)
+	// LoadOrAdd id不存在时添加channel，否则返回已经存在的Channel
+	LoadOrAdd(channel Channel) (actual Channel, loaded bool)
+	// Swap 添加channel，返回被替换的Channel
+	Swap(channel Channel) (old Channel, loaded bool)
+	// CompareAndRemove 只有id当前对应的就是channel时才删除，避免删除同一个id的新连接
+	CompareAndRemove(channel Channel) bool
+	// ByUser 返回Session.UserID为userID的所有Channel，即这个用户在线的所有设备
+	ByUser(userID string) []Channel
 }
 
-// ChannelsImpl ChannelMap
+// ChannelsImpl 基于单个sync.Map的ChannelMap，写操作使用同一把锁。
+// 连接数较多时使用NewChannels返回的分片实现
 type ChannelsImpl struct {
-	// TODO: Optimization point
+	count    int64 // 原子操作，保证32位平台上64位对齐
 	channels *sync.Map
+	mu       sync.RWMutex                  // 写操作互斥，保证LoadOrAdd、Swap、CompareAndRemove与users索引是原子的
+	users    map[string]map[string]Channel // userID -> channelID -> Channel
 }
 
-// NewChannels NewChannels
+// NewChannels 返回分片的ChannelMap，num为预计的连接数
 func NewChannels(num int) ChannelMap {
+	return NewShardedChannels(DefaultChannelShards, num)
+}
+
+// NewSyncMapChannels 返回基于sync.Map的ChannelsImpl
+func NewSyncMapChannels() ChannelMap {
 	return &ChannelsImpl{
 		channels: new(sync.Map),
+		users:    make(map[string]map[string]Channel),
+	}
+}
+
+// index 需要持有mu
+func (ch *ChannelsImpl) index(channel Channel) {
+	session := channel.Session()
+	if session == nil || session.UserID == "" {
+		return
+	}
+	devices, ok := ch.users[session.UserID]
+	if !ok {
+		devices = make(map[string]Channel)
+		ch.users[session.UserID] = devices
+	}
+	devices[channel.ID()] = channel
+}
+
+// unindex 需要持有mu
+func (ch *ChannelsImpl) unindex(channel Channel) {
+	session := channel.Session()
+	if session == nil || session.UserID == "" {
+		return
+	}
+	devices := ch.users[session.UserID]
+	if devices[channel.ID()] != channel {
+		return
+	}
+	delete(devices, channel.ID())
+	if len(devices) == 0 {
+		delete(ch.users, session.UserID)
 	}
 }
 
+// store 替换id对应的Channel并更新索引，需要持有mu
+func (ch *ChannelsImpl) store(channel Channel) (Channel, bool) {
+	old, loaded := ch.channels.Load(channel.ID())
+	if loaded {
+		ch.unindex(old.(Channel))
+	}
+	ch.channels.Store(channel.ID(), channel)
+	ch.index(channel)
+	if !loaded {
+		atomic.AddInt64(&ch.count, 1)
+		return nil, false
+	}
+	return old.(Channel), true
+}
+
+// delete 删除id对应的Channel并更新索引，需要持有mu
+func (ch *ChannelsImpl) delete(channel Channel) {
+	ch.channels.Delete(channel.ID())
+	ch.unindex(channel)
+	atomic.AddInt64(&ch.count, -1)
+}
+
 // Add addChannel
 func (ch *ChannelsImpl) Add(channel Channel) {
 	if channel.ID() == "" {
@@ -35,12 +110,60 @@ func (ch *ChannelsImpl) Add(channel Channel) {
 		}).Error("channel id is required")
 	}
 
-	ch.channels.Store(channel.ID(), channel)
+	ch.mu.Lock()
+	ch.store(channel)
+	ch.mu.Unlock()
 }
 
 // Remove addChannel
 func (ch *ChannelsImpl) Remove(id string) {
-	ch.channels.Delete(id)
+	ch.mu.Lock()
+	if val, ok := ch.channels.Load(id); ok {
+		ch.delete(val.(Channel))
+	}
+	ch.mu.Unlock()
+}
+
+// LoadOrAdd LoadOrAdd
+func (ch *ChannelsImpl) LoadOrAdd(channel Channel) (Channel, bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if actual, ok := ch.channels.Load(channel.ID()); ok {
+		return actual.(Channel), true
+	}
+	ch.store(channel)
+	return channel, false
+}
+
+// Swap Swap
+func (ch *ChannelsImpl) Swap(channel Channel) (Channel, bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.store(channel)
+}
+
+// CompareAndRemove CompareAndRemove
+func (ch *ChannelsImpl) CompareAndRemove(channel Channel) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	val, ok := ch.channels.Load(channel.ID())
+	if !ok || val.(Channel) != channel {
+		return false
+	}
+	ch.delete(channel)
+	return true
+}
+
+// ByUser ByUser
+func (ch *ChannelsImpl) ByUser(userID string) []Channel {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	devices := ch.users[userID]
+	arr := make([]Channel, 0, len(devices))
+	for _, channel := range devices {
+		arr = append(arr, channel)
+	}
+	return arr
 }
 
 // Get Get
@@ -67,3 +190,32 @@ func (ch *ChannelsImpl) All() []Channel {
 	})
 	return arr
 }
+
+// Len Len
+func (ch *ChannelsImpl) Len() int {
+	return int(atomic.LoadInt64(&ch.count))
+}
+
+// Range Range
+func (ch *ChannelsImpl) Range(f func(Channel) bool) {
+	ch.channels.Range(func(key, val interface{}) bool {
+		return f(val.(Channel))
+	})
+}
+
+// ShutdownChannels 并发地调用所有Channel的Shutdown，返回时每个Channel都已经关闭
+func ShutdownChannels(ctx context.Context, channels ChannelMap, reason string) {
+	shutdownChannels(ctx, channels.All(), reason)
+}
+
+func shutdownChannels(ctx context.Context, list []Channel, reason string) {
+	var wg sync.WaitGroup
+	for _, ch := range list {
+		wg.Add(1)
+		go func(ch Channel) {
+			defer wg.Done()
+			_ = ch.Shutdown(ctx, reason)
+		}(ch)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,227 @@
+package kim
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sunrnalike/sun/logger"
+)
+
+// DefaultChannelShards NewChannels使用的分片数
+const DefaultChannelShards = 32
+
+// ShardedChannels 按channelId的hash分片的ChannelMap，每个分片一把读写锁，
+// 大量连接同时登录时写操作分散在不同的分片上。users索引按userId单独分片，
+// 加锁顺序总是先channel分片后user分片
+type ShardedChannels struct {
+	count  int64 // 原子操作，保证32位平台上64位对齐
+	mask   uint32
+	shards []channelShard
+	users  []userShard
+}
+
+type channelShard struct {
+	sync.RWMutex
+	channels map[string]Channel
+}
+
+type userShard struct {
+	sync.RWMutex
+	users map[string]map[string]Channel // userID -> channelID -> Channel
+}
+
+// NewShardedChannels shards会向上取整为2的幂，num为预计的连接数，用于预分配每个分片
+func NewShardedChannels(shards, num int) ChannelMap {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	m := &ShardedChannels{
+		mask:   uint32(n - 1),
+		shards: make([]channelShard, n),
+		users:  make([]userShard, n),
+	}
+	for i := range m.shards {
+		m.shards[i].channels = make(map[string]Channel, num/n)
+		m.users[i].users = make(map[string]map[string]Channel)
+	}
+	return m
+}
+
+// fnv32a 内联的FNV-1a，避免[]byte转换的内存分配
+func fnv32a(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+func (m *ShardedChannels) shard(id string) *channelShard {
+	return &m.shards[fnv32a(id)&m.mask]
+}
+
+func (m *ShardedChannels) userShard(userID string) *userShard {
+	return &m.users[fnv32a(userID)&m.mask]
+}
+
+func (m *ShardedChannels) index(channel Channel) {
+	session := channel.Session()
+	if session == nil || session.UserID == "" {
+		return
+	}
+	us := m.userShard(session.UserID)
+	us.Lock()
+	devices, ok := us.users[session.UserID]
+	if !ok {
+		devices = make(map[string]Channel)
+		us.users[session.UserID] = devices
+	}
+	devices[channel.ID()] = channel
+	us.Unlock()
+}
+
+func (m *ShardedChannels) unindex(channel Channel) {
+	session := channel.Session()
+	if session == nil || session.UserID == "" {
+		return
+	}
+	us := m.userShard(session.UserID)
+	us.Lock()
+	devices := us.users[session.UserID]
+	if devices[channel.ID()] == channel {
+		delete(devices, channel.ID())
+		if len(devices) == 0 {
+			delete(us.users, session.UserID)
+		}
+	}
+	us.Unlock()
+}
+
+// store 替换id对应的Channel并更新索引，需要持有分片的写锁
+func (m *ShardedChannels) store(s *channelShard, channel Channel) (Channel, bool) {
+	old, loaded := s.channels[channel.ID()]
+	if loaded {
+		m.unindex(old)
+	} else {
+		atomic.AddInt64(&m.count, 1)
+	}
+	s.channels[channel.ID()] = channel
+	m.index(channel)
+	return old, loaded
+}
+
+// delete 需要持有分片的写锁
+func (m *ShardedChannels) delete(s *channelShard, channel Channel) {
+	delete(s.channels, channel.ID())
+	m.unindex(channel)
+	atomic.AddInt64(&m.count, -1)
+}
+
+// Add Add
+func (m *ShardedChannels) Add(channel Channel) {
+	if channel.ID() == "" {
+		logger.WithFields(logger.Fields{
+			"module": "ShardedChannels",
+		}).Error("channel id is required")
+	}
+	s := m.shard(channel.ID())
+	s.Lock()
+	m.store(s, channel)
+	s.Unlock()
+}
+
+// Remove Remove
+func (m *ShardedChannels) Remove(id string) {
+	s := m.shard(id)
+	s.Lock()
+	if channel, ok := s.channels[id]; ok {
+		m.delete(s, channel)
+	}
+	s.Unlock()
+}
+
+// Get Get
+func (m *ShardedChannels) Get(id string) (Channel, bool) {
+	s := m.shard(id)
+	s.RLock()
+	channel, ok := s.channels[id]
+	s.RUnlock()
+	return channel, ok
+}
+
+// LoadOrAdd LoadOrAdd
+func (m *ShardedChannels) LoadOrAdd(channel Channel) (Channel, bool) {
+	s := m.shard(channel.ID())
+	s.Lock()
+	defer s.Unlock()
+	if actual, ok := s.channels[channel.ID()]; ok {
+		return actual, true
+	}
+	m.store(s, channel)
+	return channel, false
+}
+
+// Swap Swap
+func (m *ShardedChannels) Swap(channel Channel) (Channel, bool) {
+	s := m.shard(channel.ID())
+	s.Lock()
+	defer s.Unlock()
+	return m.store(s, channel)
+}
+
+// CompareAndRemove CompareAndRemove
+func (m *ShardedChannels) CompareAndRemove(channel Channel) bool {
+	s := m.shard(channel.ID())
+	s.Lock()
+	defer s.Unlock()
+	if s.channels[channel.ID()] != channel {
+		return false
+	}
+	m.delete(s, channel)
+	return true
+}
+
+// ByUser ByUser
+func (m *ShardedChannels) ByUser(userID string) []Channel {
+	us := m.userShard(userID)
+	us.RLock()
+	defer us.RUnlock()
+	devices := us.users[userID]
+	arr := make([]Channel, 0, len(devices))
+	for _, channel := range devices {
+		arr = append(arr, channel)
+	}
+	return arr
+}
+
+// Len Len
+func (m *ShardedChannels) Len() int {
+	return int(atomic.LoadInt64(&m.count))
+}
+
+// Range 依次持有每个分片的读锁遍历，不分配内存
+func (m *ShardedChannels) Range(f func(Channel) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for _, channel := range s.channels {
+			if !f(channel) {
+				s.RUnlock()
+				return
+			}
+		}
+		s.RUnlock()
+	}
+}
+
+// All return channels
+func (m *ShardedChannels) All() []Channel {
+	arr := make([]Channel, 0, m.Len())
+	m.Range(func(channel Channel) bool {
+		arr = append(arr, channel)
+		return true
+	})
+	return arr
+}
@@ -0,0 +1,180 @@
+package kim
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// channelMaps 需要对比的ChannelMap实现
+var channelMaps = []struct {
+	name string
+	new  func() ChannelMap
+}{
+	{"syncmap", NewSyncMapChannels},
+	{"sharded", func() ChannelMap { return NewChannels(10) }},
+}
+
+func TestChannelsSwap(t *testing.T) {
+	for _, impl := range channelMaps {
+		t.Run(impl.name, func(t *testing.T) {
+			channels := impl.new()
+			ch1 := &testChannel{testAgent: testAgent{id: "u1"}}
+			ch2 := &testChannel{testAgent: testAgent{id: "u1"}}
+
+			if actual, loaded := channels.LoadOrAdd(ch1); loaded || actual != ch1 {
+				t.Fatal("ch1 should be added")
+			}
+			if actual, loaded := channels.LoadOrAdd(ch2); !loaded || actual != ch1 {
+				t.Fatal("ch2 should not replace ch1")
+			}
+			if old, loaded := channels.Swap(ch2); !loaded || old != ch1 {
+				t.Fatal("ch2 should replace ch1")
+			}
+			if channels.Len() != 1 {
+				t.Fatalf("len %d, want 1", channels.Len())
+			}
+			// 旧连接退出时不能删除新的连接
+			if channels.CompareAndRemove(ch1) {
+				t.Fatal("ch1 is not in the map")
+			}
+			if ch, _ := channels.Get("u1"); ch != ch2 {
+				t.Fatal("ch2 is removed")
+			}
+			if !channels.CompareAndRemove(ch2) {
+				t.Fatal("ch2 should be removed")
+			}
+			if _, ok := channels.Get("u1"); ok {
+				t.Fatal("u1 should be removed")
+			}
+			if channels.Len() != 0 {
+				t.Fatalf("len %d, want 0", channels.Len())
+			}
+		})
+	}
+}
+
+func TestChannelsLenRange(t *testing.T) {
+	for _, impl := range channelMaps {
+		t.Run(impl.name, func(t *testing.T) {
+			channels := impl.new()
+			for i := 0; i < 100; i++ {
+				channels.Add(&testChannel{testAgent: testAgent{id: strconv.Itoa(i)}})
+			}
+			channels.Add(&testChannel{testAgent: testAgent{id: "0"}})
+			channels.Remove("1")
+			channels.Remove("not exist")
+			if channels.Len() != 99 || len(channels.All()) != 99 {
+				t.Fatalf("len %d all %d, want 99", channels.Len(), len(channels.All()))
+			}
+			seen := make(map[string]bool)
+			channels.Range(func(ch Channel) bool {
+				seen[ch.ID()] = true
+				return true
+			})
+			if len(seen) != 99 || seen["1"] {
+				t.Fatalf("range got %d channels", len(seen))
+			}
+			var count int
+			channels.Range(func(ch Channel) bool {
+				count++
+				return count < 10
+			})
+			if count != 10 {
+				t.Fatalf("range should stop at 10, got %d", count)
+			}
+		})
+	}
+}
+
+func TestShardedChannelsRangeAllocs(t *testing.T) {
+	channels := NewChannels(1000)
+	for i := 0; i < 1000; i++ {
+		channels.Add(&testChannel{testAgent: testAgent{id: strconv.Itoa(i)}})
+	}
+	var count int
+	f := func(ch Channel) bool {
+		count++
+		return true
+	}
+	if allocs := testing.AllocsPerRun(10, func() { channels.Range(f) }); allocs != 0 {
+		t.Fatalf("Range allocates %v times", allocs)
+	}
+}
+
+// BenchmarkChannelsAddRemove 模拟大量连接同时登录与断开
+func BenchmarkChannelsAddRemove(b *testing.B) {
+	for _, impl := range channelMaps {
+		b.Run(impl.name, func(b *testing.B) {
+			channels := impl.new()
+			var seq int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := strconv.FormatInt(atomic.AddInt64(&seq, 1), 10)
+					ch := &testChannel{testAgent: testAgent{id: id}}
+					channels.Add(ch)
+					channels.CompareAndRemove(ch)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkChannelsGet(b *testing.B) {
+	for _, impl := range channelMaps {
+		b.Run(impl.name, func(b *testing.B) {
+			channels := impl.new()
+			ids := make([]string, 10000)
+			for i := range ids {
+				ids[i] = strconv.Itoa(i)
+				channels.Add(&testChannel{testAgent: testAgent{id: ids[i]}})
+			}
+			var seq int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&seq, 1))
+				for pb.Next() {
+					channels.Get(ids[i%len(ids)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkChannelsAll(b *testing.B) {
+	for _, impl := range channelMaps {
+		b.Run(impl.name, func(b *testing.B) {
+			channels := impl.new()
+			for i := 0; i < 10000; i++ {
+				channels.Add(&testChannel{testAgent: testAgent{id: strconv.Itoa(i)}})
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, ch := range channels.All() {
+					_ = ch
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChannelsRange(b *testing.B) {
+	for _, impl := range channelMaps {
+		b.Run(impl.name, func(b *testing.B) {
+			channels := impl.new()
+			for i := 0; i < 10000; i++ {
+				channels.Add(&testChannel{testAgent: testAgent{id: strconv.Itoa(i)}})
+			}
+			f := func(ch Channel) bool { return true }
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				channels.Range(f)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package kim
+
+import (
+	"math"
+
+	"github.com/sunrnalike/sun/wire/pkt"
+	"google.golang.org/protobuf/proto"
+)
+
+const abortIndex int = math.MaxInt8 / 2
+
+// HandlerFunc 指令处理函数，中间件也是一个HandlerFunc
+type HandlerFunc func(Context)
+
+// HandlersChain HandlersChain
+type HandlersChain []HandlerFunc
+
+// Context 一次指令处理的上下文
+type Context interface {
+	// Header 请求包头
+	Header() *pkt.Header
+	// ReadBody 将请求包体反序列化到val中
+	ReadBody(val proto.Message) error
+	// Agent 发送该请求的通道
+	Agent() Agent
+	// Resp 给请求方返回一个响应包
+	Resp(status pkt.Status, body proto.Message) error
+	// RespWithError 给请求方返回一个错误响应，包体为错误信息
+	RespWithError(status pkt.Status, err error) error
+	// Next 执行处理链中的下一个处理函数，只能在中间件中调用
+	Next()
+	// Abort 中止后续处理函数的执行
+	Abort()
+	IsAborted() bool
+	// Set/Get 在处理链中传递数据
+	Set(key string, val interface{})
+	Get(key string) (interface{}, bool)
+}
+
+// ContextImpl ContextImpl
+type ContextImpl struct {
+	handlers HandlersChain
+	index    int
+	request  *pkt.LogicPkt
+	agent    Agent
+	keys     map[string]interface{}
+}
+
+func newContext(request *pkt.LogicPkt, agent Agent, handlers HandlersChain) *ContextImpl {
+	return &ContextImpl{
+		handlers: handlers,
+		index:    -1,
+		request:  request,
+		agent:    agent,
+	}
+}
+
+// Header Header
+func (c *ContextImpl) Header() *pkt.Header {
+	return &c.request.Header
+}
+
+// ReadBody ReadBody
+func (c *ContextImpl) ReadBody(val proto.Message) error {
+	return c.request.ReadBody(val)
+}
+
+// Agent Agent
+func (c *ContextImpl) Agent() Agent {
+	return c.agent
+}
+
+// Resp Resp
+func (c *ContextImpl) Resp(status pkt.Status, body proto.Message) error {
+	packet := pkt.NewFrom(&c.request.Header)
+	packet.Status = status
+	packet.WriteBody(body)
+	return c.agent.Push(pkt.Marshal(packet))
+}
+
+// RespWithError RespWithError
+func (c *ContextImpl) RespWithError(status pkt.Status, err error) error {
+	packet := pkt.NewFrom(&c.request.Header)
+	packet.Status = status
+	if err != nil {
+		packet.Body = []byte(err.Error())
+	}
+	return c.agent.Push(pkt.Marshal(packet))
+}
+
+// Next Next
+func (c *ContextImpl) Next() {
+	c.index++
+	for c.index < len(c.handlers) {
+		c.handlers[c.index](c)
+		c.index++
+	}
+}
+
+// Abort Abort
+func (c *ContextImpl) Abort() {
+	c.index = abortIndex
+}
+
+// IsAborted IsAborted
+func (c *ContextImpl) IsAborted() bool {
+	return c.index >= abortIndex
+}
+
+// Set Set
+func (c *ContextImpl) Set(key string, val interface{}) {
+	if c.keys == nil {
+		c.keys = make(map[string]interface{})
+	}
+	c.keys[key] = val
+}
+
+// Get Get
+func (c *ContextImpl) Get(key string) (interface{}, bool) {
+	val, ok := c.keys[key]
+	return val, ok
+}
@@ -0,0 +1,110 @@
+package kim
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// DuplicatePolicy 同一个channelId重复登录时的处理策略
+type DuplicatePolicy int
+
+// duplicate policies
+const (
+	// DuplicateReject 拒绝新的连接，默认的策略
+	DuplicateReject DuplicatePolicy = iota
+	// DuplicateKickOld 踢掉旧的连接：发送一个原因为CloseReasonKicked的OpClose帧之后关闭它
+	DuplicateKickOld
+	// DuplicateAllow 两个连接都保留，新的连接替换ChannelMap中的索引，Push只会发送到新的连接，
+	// 旧的连接记录在ReplacedChannels中，关闭时同样回调Disconnect，Shutdown时一起关闭
+	DuplicateAllow
+)
+
+// CloseReasonKicked 旧连接被同一个channelId的新登录踢掉时OpClose帧中的原因
+const CloseReasonKicked = "kicked by another login"
+
+// ErrChannelRepeated 同一个channelId已经在线，Error()作为OpClose帧中的原因
+var ErrChannelRepeated = errors.New("channelId is repeated")
+
+// AddWithPolicy 按照policy把握手完成的channel原子地加入channels。
+// 返回error时需要拒绝新的连接；踢掉旧连接时返回被踢掉的Channel，
+// 调用方需要为它回调StateListener.Disconnect，它自己的Readloop退出之后
+// CompareAndRemove返回false，不会再次回调。
+// DuplicateAllow时被替换的连接记录在replaced中，连接关闭时通过replaced.Logout判断是否需要回调
+func AddWithPolicy(channels ChannelMap, channel Channel, policy DuplicatePolicy, replaced *ReplacedChannels) (Channel, error) {
+	switch policy {
+	case DuplicateKickOld:
+		old, loaded := channels.Swap(channel)
+		if !loaded {
+			return nil, nil
+		}
+		_ = old.WriteFrame(OpClose, []byte(CloseReasonKicked))
+		_ = old.Close()
+		return old, nil
+	case DuplicateAllow:
+		replaced.swap(channels, channel)
+		return nil, nil
+	default:
+		if _, loaded := channels.LoadOrAdd(channel); loaded {
+			return nil, ErrChannelRepeated
+		}
+		return nil, nil
+	}
+}
+
+// ReplacedChannels DuplicateAllow时被同一个channelId的新连接替换、但仍然在线的Channel，
+// 它们已经不在ChannelMap中。零值可以直接使用，方法对nil也是安全的，此时不记录被替换的连接
+type ReplacedChannels struct {
+	mu       sync.Mutex
+	channels map[Channel]struct{}
+}
+
+// swap 与连接关闭时的Logout互斥，旧的连接要么还在channels中，要么已经记录在这里
+func (r *ReplacedChannels) swap(channels ChannelMap, channel Channel) {
+	if r == nil {
+		channels.Swap(channel)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, loaded := channels.Swap(channel)
+	if !loaded {
+		return
+	}
+	if r.channels == nil {
+		r.channels = make(map[Channel]struct{})
+	}
+	r.channels[old] = struct{}{}
+}
+
+// Logout 连接关闭时调用，把channel从channels或者被替换的连接中删除。
+// 返回true时调用方需要回调StateListener.Disconnect，被踢掉的连接返回false
+func (r *ReplacedChannels) Logout(channels ChannelMap, channel Channel) bool {
+	if channels.CompareAndRemove(channel) {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.channels[channel]; ok {
+		delete(r.channels, channel)
+		return true
+	}
+	return false
+}
+
+// Shutdown 与ShutdownChannels相同，关闭所有被替换的连接
+func (r *ReplacedChannels) Shutdown(ctx context.Context, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	list := make([]Channel, 0, len(r.channels))
+	for ch := range r.channels {
+		list = append(list, ch)
+	}
+	r.mu.Unlock()
+	shutdownChannels(ctx, list, reason)
+}
@@ -6,11 +6,13 @@ import (
 	"net"
 	"time"
 
-	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/polling"
 	"github.com/sunrnalike/sun/tcp"
 	"github.com/sunrnalike/sun/websocket"
+	"github.com/sunrnalike/sun/wire"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 // ClientDemo Client demo
@@ -26,8 +28,11 @@ func (c *ClientDemo) Start(userID, protocol, addr string) {
 		// set dialer
 		cli.SetDialer(&WebsocketDialer{})
 	} else if protocol == "tcp" {
-		cli = tcp.NewClient("test1", "client", tcp.ClientOptions{})
+		cli = tcp.NewClient("test1", "client", tcp.ClientOptions{Compress: true})
 		cli.SetDialer(&TCPDialer{})
+	} else if protocol == "poll" {
+		// 默认的polling.Dialer把userID作为握手帧发送，addr如 http://localhost:8000/
+		cli = polling.NewClient(userID, "client", polling.ClientOptions{})
 	}
 
 	// step2: 建立连接
@@ -39,7 +44,9 @@ func (c *ClientDemo) Start(userID, protocol, addr string) {
 	go func() {
 		// step3: 发送消息然后退出
 		for i := 0; i < count; i++ {
-			err := cli.Send([]byte("hello"))
+			req := pkt.New(wire.CommandChatUserTalk, pkt.WithDest("server"))
+			req.Body = []byte("hello")
+			err := cli.SendPkt(req)
 			if err != nil {
 				logger.Error(err)
 				return
@@ -51,16 +58,17 @@ func (c *ClientDemo) Start(userID, protocol, addr string) {
 	// step4: 接收消息
 	recv := 0
 	for {
-		frame, err := cli.Read()
+		p, err := cli.ReadPkt()
 		if err != nil {
 			logger.Info(err)
 			break
 		}
-		if frame.GetOpCode() != sun.OpBinary {
+		resp, ok := p.(*pkt.LogicPkt)
+		if !ok {
 			continue
 		}
 		recv++
-		logger.Warnf("%s receive message [%s]", cli.ID(), frame.GetPayload())
+		logger.Warnf("%s receive message [%s]", cli.ID(), resp.StringBody())
 		if recv == count { // 接收完消息
 			break
 		}
@@ -75,8 +83,11 @@ type WebsocketDialer struct {
 
 // DialAndHandshake DialAndHandshake
 func (d *WebsocketDialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
-	// 1 调用ws.Dial拨号
-	conn, _, _, err := ws.Dial(context.TODO(), ctx.Address)
+	// 1 拨号，并请求permessage-deflate压缩
+	conn, err := websocket.Dial(context.TODO(), ctx.Address, websocket.DialOptions{
+		Compress:  true,
+		TLSConfig: ctx.TLSConfig,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -96,13 +107,13 @@ type TCPDialer struct {
 // DialAndHandshake DialAndHandshake
 func (d *TCPDialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
 	logger.Info("start dial: ", ctx.Address)
-	// 1 调用net.Dial拨号
-	conn, err := net.DialTimeout("tcp", ctx.Address, ctx.Timeout)
+	// 1 拨号，ctx.TLSConfig不为nil时使用TLS
+	conn, err := tcp.Dial(ctx.Address, ctx.Timeout, ctx.TLSConfig)
 	if err != nil {
 		return nil, err
 	}
-	// 2. 发送用户认证信息，示例就是userid
-	err = tcp.WriteFrame(conn, sun.OpBinary, []byte(ctx.Id))
+	// 2. 发送用户认证信息，示例就是userid，同时声明支持压缩
+	err = tcp.WriteFrameWithFlags(conn, sun.OpBinary, tcp.FlagCompressAccept, []byte(ctx.Id))
 	if err != nil {
 		return nil, err
 	}
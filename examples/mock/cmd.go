@@ -25,7 +25,7 @@ func NewClientCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	cmd.PersistentFlags().StringVarP(&opts.addr, "address", "a", "ws://localhost:8000", "server address")
-	cmd.PersistentFlags().StringVarP(&opts.protocol, "protocol", "p", "ws", "protocol ws or tcp")
+	cmd.PersistentFlags().StringVarP(&opts.protocol, "protocol", "p", "ws", "protocol ws, tcp or poll")
 	return cmd
 }
 
@@ -47,7 +47,7 @@ func NewServerCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	cmd.PersistentFlags().StringVarP(&opts.addr, "address", "a", ":8000", "listen address")
-	cmd.PersistentFlags().StringVarP(&opts.protocol, "protocol", "p", "ws", "protocol ws or tcp")
+	cmd.PersistentFlags().StringVarP(&opts.protocol, "protocol", "p", "ws", "protocol ws, tcp or poll")
 	return cmd
 }
 
@@ -1,14 +1,18 @@
 package mock
 
 import (
+	"bytes"
+	"compress/flate"
 	"errors"
 	sun "github.com/sunrnalike/sun"
 	"time"
 
 	"github.com/sunrnalike/sun/logger"
 	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/polling"
 	"github.com/sunrnalike/sun/tcp"
 	"github.com/sunrnalike/sun/websocket"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 type ServerDemo struct{}
@@ -20,9 +24,11 @@ func (s *ServerDemo) Start(id, protocol, addr string) {
 		Protocol: protocol,
 	}
 	if protocol == "ws" {
-		srv = websocket.NewServer(addr, service)
+		srv = websocket.NewServer(addr, service, websocket.WithCompression(flate.BestSpeed, 256))
 	} else if protocol == "tcp" {
-		srv = tcp.NewServer(addr, service)
+		srv = tcp.NewServer(addr, service, tcp.WithCompression(flate.BestSpeed, 256))
+	} else if protocol == "poll" {
+		srv = polling.NewServer(addr, service)
 	}
 
 	handler := &ServerHandler{}
@@ -43,30 +49,36 @@ type ServerHandler struct {
 }
 
 // Accept this connection
-func (h *ServerHandler) Accept(conn sun.Conn, timeout time.Duration) (string, error) {
+func (h *ServerHandler) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
 	// 1. 读取：客户端发送的鉴权数据包
 	frame, err := conn.ReadFrame()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	logger.Info("recv", frame.GetOpCode())
 	// 2. 解析：数据包内容就是userId
 	userID := string(frame.GetPayload())
 	// 3. 鉴权：这里只是为了示例做一个fake验证，非空
 	if userID == "" {
-		return "", errors.New("user id is invalid")
+		return nil, errors.New("user id is invalid")
 	}
-	return userID, nil
+	return &sun.Session{ChannelID: userID, UserID: userID}, nil
 }
 
 // Receive default listener
 func (h *ServerHandler) Receive(ag sun.Agent, payload []byte) {
-	ack := string(payload) + " from server "
-	_ = ag.Push([]byte(ack))
+	req, err := pkt.MustReadLogicPkt(bytes.NewReader(payload))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	resp := pkt.NewFrom(&req.Header)
+	resp.Body = []byte(req.StringBody() + " from server ")
+	_ = ag.Push(pkt.Marshal(resp))
 }
 
 // Disconnect default listener
-func (h *ServerHandler) Disconnect(id string) error {
-	logger.Warnf("disconnect %s", id)
+func (h *ServerHandler) Disconnect(session *sun.Session) error {
+	logger.Warnf("disconnect %s from %s", session.ChannelID, session.RemoteIP)
 	return nil
 }
@@ -3,9 +3,9 @@ module github.com/sunrnalike/sun
 go 1.16
 
 require (
-	github.com/gobwas/httphead v0.0.0-20200921212729-da3d93bc3c58 // indirect
-	github.com/gobwas/pool v0.2.1 // indirect
-	github.com/gobwas/ws v1.0.4
+	github.com/gobwas/httphead v0.1.0
+	github.com/gobwas/ws v1.1.0
+	github.com/golang/protobuf v1.4.1
 	github.com/google/go-cmp v0.5.4 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/jonboulle/clockwork v0.1.0 // indirect
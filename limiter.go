@@ -0,0 +1,193 @@
+package kim
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接被限制时的错误，Error()作为OpClose帧中的原因发送给客户端
+var (
+	ErrTooManyChannels   = errors.New("too many channels")
+	ErrTooManyHandshakes = errors.New("too many pending handshakes")
+	ErrRateLimited       = errors.New("connection rate limited")
+)
+
+// Limits 连接限制，字段为0时表示不限制
+type Limits struct {
+	MaxChannels   int     // 握手完成的连接总数
+	MaxHandshakes int     // 同时处于握手阶段的连接数
+	IPRate        float64 // 每个IP每秒允许新建的连接数
+	IPBurst       int     // 每个IP令牌桶的容量，为0时等于IPRate
+}
+
+// LimiterStats 当前的连接数与被拒绝的连接数
+type LimiterStats struct {
+	Channels           int64
+	Handshakes         int64
+	RejectedChannels   uint64
+	RejectedHandshakes uint64
+	RejectedRate       uint64
+}
+
+// Limiter 连接限制器，可以被多个Server共享。方法对nil Limiter也是安全的，此时不做任何限制
+type Limiter struct {
+	// 原子操作的字段放在最前面，保证32位平台上64位对齐
+	channels   int64
+	handshakes int64
+	rejected   struct {
+		channels   uint64
+		handshakes uint64
+		rate       uint64
+	}
+	limits    Limits
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket 单个IP的令牌桶
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter NewLimiter
+func NewLimiter(limits Limits) *Limiter {
+	if limits.IPRate > 0 && limits.IPBurst <= 0 {
+		limits.IPBurst = int(limits.IPRate)
+		if limits.IPBurst < 1 {
+			limits.IPBurst = 1
+		}
+	}
+	return &Limiter{
+		limits:    limits,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// BeginHandshake 连接建立时调用，返回nil时需要在握手结束之后调用EndHandshake
+func (l *Limiter) BeginHandshake() error {
+	if l == nil {
+		return nil
+	}
+	n := atomic.AddInt64(&l.handshakes, 1)
+	if l.limits.MaxHandshakes > 0 && n > int64(l.limits.MaxHandshakes) {
+		atomic.AddInt64(&l.handshakes, -1)
+		atomic.AddUint64(&l.rejected.handshakes, 1)
+		return ErrTooManyHandshakes
+	}
+	return nil
+}
+
+// EndHandshake 握手结束，无论成功与否
+func (l *Limiter) EndHandshake() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.handshakes, -1)
+}
+
+// Allow 检查来源IP的新建连接速率
+func (l *Limiter) Allow(addr net.Addr) error {
+	if l == nil || l.limits.IPRate <= 0 || addr == nil {
+		return nil
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(l.limits.IPBurst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.limits.IPRate
+	if b.tokens > float64(l.limits.IPBurst) {
+		b.tokens = float64(l.limits.IPBurst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		atomic.AddUint64(&l.rejected.rate, 1)
+		return ErrRateLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// sweep 每分钟清理一次已经装满的令牌桶，它们与新建的令牌桶没有区别，需要持有mu
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limits.IPRate >= float64(l.limits.IPBurst) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// AddChannel 握手完成之后占用一个连接数，返回nil时需要在连接关闭之后调用RemoveChannel
+func (l *Limiter) AddChannel() error {
+	if l == nil {
+		return nil
+	}
+	n := atomic.AddInt64(&l.channels, 1)
+	if l.limits.MaxChannels > 0 && n > int64(l.limits.MaxChannels) {
+		atomic.AddInt64(&l.channels, -1)
+		atomic.AddUint64(&l.rejected.channels, 1)
+		return ErrTooManyChannels
+	}
+	return nil
+}
+
+// CheckChannels 连接数已经达到MaxChannels时返回ErrTooManyChannels，不占用连接数，
+// 用于在握手之前提前拒绝，握手完成之后仍然需要调用AddChannel
+func (l *Limiter) CheckChannels() error {
+	if l == nil || l.limits.MaxChannels <= 0 {
+		return nil
+	}
+	if atomic.LoadInt64(&l.channels) >= int64(l.limits.MaxChannels) {
+		atomic.AddUint64(&l.rejected.channels, 1)
+		return ErrTooManyChannels
+	}
+	return nil
+}
+
+// RemoveChannel 释放AddChannel占用的连接数
+func (l *Limiter) RemoveChannel() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.channels, -1)
+}
+
+// Stats 返回当前的统计数据
+func (l *Limiter) Stats() LimiterStats {
+	if l == nil {
+		return LimiterStats{}
+	}
+	return LimiterStats{
+		Channels:           atomic.LoadInt64(&l.channels),
+		Handshakes:         atomic.LoadInt64(&l.handshakes),
+		RejectedChannels:   atomic.LoadUint64(&l.rejected.channels),
+		RejectedHandshakes: atomic.LoadUint64(&l.rejected.handshakes),
+		RejectedRate:       atomic.LoadUint64(&l.rejected.rate),
+	}
+}
+
+// Publish 通过expvar以name发布Stats，可以从/debug/vars中采集，同一个name只能发布一次
+func (l *Limiter) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return l.Stats()
+	}))
+}
@@ -0,0 +1,64 @@
+package kim
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLimiterHandshakesAndChannels(t *testing.T) {
+	l := NewLimiter(Limits{MaxChannels: 1, MaxHandshakes: 1})
+	if err := l.BeginHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.BeginHandshake(); err != ErrTooManyHandshakes {
+		t.Fatalf("got %v, want ErrTooManyHandshakes", err)
+	}
+	l.EndHandshake()
+	if err := l.CheckChannels(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddChannel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckChannels(); err != ErrTooManyChannels {
+		t.Fatalf("got %v, want ErrTooManyChannels", err)
+	}
+	if err := l.AddChannel(); err != ErrTooManyChannels {
+		t.Fatalf("got %v, want ErrTooManyChannels", err)
+	}
+	l.RemoveChannel()
+	if err := l.AddChannel(); err != nil {
+		t.Fatal(err)
+	}
+	stats := l.Stats()
+	if stats.Channels != 1 || stats.Handshakes != 0 || stats.RejectedChannels != 2 || stats.RejectedHandshakes != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// nil Limiter不做任何限制
+	var unlimited *Limiter
+	if unlimited.BeginHandshake() != nil || unlimited.Allow(nil) != nil || unlimited.AddChannel() != nil || unlimited.CheckChannels() != nil {
+		t.Fatal("nil limiter should allow everything")
+	}
+}
+
+func TestLimiterIPRate(t *testing.T) {
+	l := NewLimiter(Limits{IPRate: 0.001, IPBurst: 2})
+	addr1 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	addr2 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	for i := 0; i < 2; i++ {
+		if err := l.Allow(&net.TCPAddr{IP: addr1.IP, Port: 2000 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Allow(addr1); err != ErrRateLimited {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	// 不同的IP使用各自的令牌桶
+	if err := l.Allow(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Stats().RejectedRate; got != 1 {
+		t.Fatalf("rejected %d, want 1", got)
+	}
+}
@@ -0,0 +1,165 @@
+package mem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// ClientOptions ClientOptions
+type ClientOptions struct {
+	ReadWait  time.Duration //读超时
+	WriteWait time.Duration //写超时
+}
+
+// Client 是一个进程内的Client实现，Connect的地址就是Server监听的名字
+type Client struct {
+	sync.Mutex
+	sun.Dialer
+	once    sync.Once
+	id      string
+	name    string
+	conn    sun.Conn
+	state   int32
+	options ClientOptions
+}
+
+// NewClient NewClient，默认使用Dialer完成握手
+func NewClient(id, name string, opts ClientOptions) sun.Client {
+	if opts.WriteWait == 0 {
+		opts.WriteWait = sun.DefaultWriteWait
+	}
+	if opts.ReadWait == 0 {
+		opts.ReadWait = sun.DefaultReadWait
+	}
+	return &Client{
+		Dialer:  new(Dialer),
+		id:      id,
+		name:    name,
+		options: opts,
+	}
+}
+
+// ID return id
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Name Name
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Connect to server
+func (c *Client) Connect(addr string) error {
+	if !atomic.CompareAndSwapInt32(&c.state, 0, 1) {
+		return fmt.Errorf("client has connected")
+	}
+	rawconn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
+		Id:      c.id,
+		Name:    c.name,
+		Address: addr,
+		Timeout: sun.DefaultLoginWait,
+	})
+	if err != nil {
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
+		return err
+	}
+	c.conn = NewConn(rawconn)
+	return nil
+}
+
+// SetDialer 设置握手逻辑
+func (c *Client) SetDialer(dialer sun.Dialer) {
+	c.Dialer = dialer
+}
+
+// Send data to connection
+func (c *Client) Send(payload []byte) error {
+	if atomic.LoadInt32(&c.state) == 0 {
+		return fmt.Errorf("connection is nil")
+	}
+	c.Lock()
+	defer c.Unlock()
+	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteFrame(sun.OpBinary, payload)
+}
+
+// SendPkt 序列化消息包并发送
+func (c *Client) SendPkt(p pkt.Packet) error {
+	return c.Send(pkt.Marshal(p))
+}
+
+// Close 关闭
+func (c *Client) Close() {
+	c.once.Do(func() {
+		if c.conn == nil {
+			return
+		}
+		// graceful close connection
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+		_ = c.conn.WriteFrame(sun.OpClose, nil)
+
+		c.conn.Close()
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
+	})
+}
+
+func (c *Client) Read() (sun.Frame, error) {
+	if c.conn == nil {
+		return nil, errors.New("connection is nil")
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+	frame, err := c.conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frame.GetOpCode() == sun.OpClose {
+		return nil, errors.New("remote side close the channel")
+	}
+	return frame, nil
+}
+
+// ReadPkt 读取并解码一个消息包，控制帧会被跳过
+func (c *Client) ReadPkt() (interface{}, error) {
+	for {
+		frame, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if frame.GetOpCode() != sun.OpBinary {
+			continue
+		}
+		return pkt.Read(bytes.NewReader(frame.GetPayload()))
+	}
+}
+
+// Dialer 连接到ctx.Address，并把ctx.Id作为握手帧发送给服务端，
+// 服务端的Acceptor读取第一个帧即可拿到它
+type Dialer struct {
+}
+
+// DialAndHandshake DialAndHandshake
+func (d *Dialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
+	conn, err := DialConn(ctx.Address)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(ctx.Timeout))
+	if err = NewConn(conn).WriteFrame(sun.OpBinary, []byte(ctx.Id)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
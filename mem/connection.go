@@ -0,0 +1,82 @@
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+// Frame Frame
+type Frame struct {
+	OpCode  sun.OpCode
+	Payload []byte
+}
+
+// SetOpCode SetOpCode
+func (f *Frame) SetOpCode(code sun.OpCode) {
+	f.OpCode = code
+}
+
+// GetOpCode GetOpCode
+func (f *Frame) GetOpCode() sun.OpCode {
+	return f.OpCode
+}
+
+// SetPayload SetPayload
+func (f *Frame) SetPayload(payload []byte) {
+	f.Payload = payload
+}
+
+// GetPayload GetPayload
+func (f *Frame) GetPayload() []byte {
+	return f.Payload
+}
+
+// MemConn 使用与tcp相同的 [opcode u8][len u32][payload] 帧格式
+type MemConn struct {
+	net.Conn
+}
+
+// NewConn NewConn
+func NewConn(conn net.Conn) *MemConn {
+	return &MemConn{
+		Conn: conn,
+	}
+}
+
+// ReadFrame 读取一个帧，payload超过sun.DefaultMaxFrameSize时返回sun.ErrFrameTooLarge
+func (c *MemConn) ReadFrame() (sun.Frame, error) {
+	opcode, err := endian.ReadUint8(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := endian.ReadBytesLimit(c.Conn, sun.DefaultMaxFrameSize)
+	if errors.Is(err, endian.ErrBytesTooLong) {
+		return nil, fmt.Errorf("%w: exceeds limit %d", sun.ErrFrameTooLarge, sun.DefaultMaxFrameSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{
+		OpCode:  sun.OpCode(opcode),
+		Payload: payload,
+	}, nil
+}
+
+// WriteFrame 一次Write写出整个帧，net.Pipe会保证并发写入的帧不会交错
+func (c *MemConn) WriteFrame(code sun.OpCode, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = byte(code)
+	endian.Default.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Flush Flush
+func (c *MemConn) Flush() error {
+	return nil
+}
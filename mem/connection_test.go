@@ -0,0 +1,27 @@
+package mem
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+func TestReadFrameTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		// 只发送一个伪造的长度前缀，不发送payload
+		_ = endian.WriteUint8(cli, uint8(sun.OpBinary))
+		_ = endian.WriteUint32(cli, 0xffffffff)
+	}()
+
+	_, err := NewConn(srv).ReadFrame()
+	if !errors.Is(err, sun.ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+}
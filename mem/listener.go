@@ -0,0 +1,99 @@
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// errors
+var (
+	ErrListenerClosed = errors.New("mem: listener closed")
+)
+
+// Network 内存连接的网络名
+const Network = "mem"
+
+// Addr 内存连接的地址，就是监听时使用的名字
+type Addr string
+
+// Network Network
+func (a Addr) Network() string { return Network }
+
+func (a Addr) String() string { return string(a) }
+
+var listeners sync.Map // name -> *listener
+
+// listener 实现net.Listener，通过名字查找，不占用任何端口
+type listener struct {
+	name  string
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+// Listen 监听一个名字，同一个名字只能被监听一次
+func Listen(name string) (net.Listener, error) {
+	l := &listener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	if _, loaded := listeners.LoadOrStore(name, l); loaded {
+		return nil, fmt.Errorf("mem: %s is already in use", name)
+	}
+	return l, nil
+}
+
+// Accept Accept
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close Close
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		listeners.Delete(l.name)
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr Addr
+func (l *listener) Addr() net.Addr {
+	return Addr(l.name)
+}
+
+// DialConn 连接到一个名字，返回一个net.Pipe的一端
+func DialConn(name string) (net.Conn, error) {
+	val, ok := listeners.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("mem: no listener on %s", name)
+	}
+	l := val.(*listener)
+	cli, srv := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{Conn: srv, local: Addr(name), remote: Addr(name + ".client")}:
+		return &pipeConn{Conn: cli, local: Addr(name + ".client"), remote: Addr(name)}, nil
+	case <-l.done:
+		cli.Close()
+		srv.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+// pipeConn 覆盖net.Pipe的地址
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
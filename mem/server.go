@@ -0,0 +1,245 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/naming"
+)
+
+// ServerOptions ServerOptions
+type ServerOptions struct {
+	loginwait time.Duration //登陆超时
+	readwait  time.Duration //读超时
+	writewait time.Duration //写超时
+}
+
+// Server 是一个进程内的Server实现，通过名字寻址，
+// 用于在不打开端口的情况下测试Acceptor、MessageListener等业务逻辑
+type Server struct {
+	listen string
+	naming.ServiceRegistration
+	sun.ChannelMap
+	sun.Acceptor
+	sun.MessageListener
+	sun.StateListener
+	once    sync.Once
+	options ServerOptions
+	quit    *sun.Event
+	lock    sync.Mutex // 保护lst，保证Shutdown之后不再增加wg
+	lst     net.Listener
+	wg      sync.WaitGroup // 连接协程，Shutdown等待它们执行完Disconnect
+}
+
+// NewServer NewServer
+func NewServer(listen string, service naming.ServiceRegistration) sun.Server {
+	return &Server{
+		listen:              listen,
+		ServiceRegistration: service,
+		ChannelMap:          sun.NewChannels(100),
+		quit:                sun.NewEvent(),
+		options: ServerOptions{
+			loginwait: sun.DefaultLoginWait,
+			readwait:  sun.DefaultReadWait,
+			writewait: sun.DefaultWriteWait,
+		},
+	}
+}
+
+// Start server
+func (s *Server) Start() error {
+	log := logger.WithFields(logger.Fields{
+		"module": "mem.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	})
+
+	if s.StateListener == nil {
+		return fmt.Errorf("StateListener is nil")
+	}
+	if s.Acceptor == nil {
+		s.Acceptor = new(defaultAcceptor)
+	}
+
+	lst, err := Listen(s.listen)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.quit.HasFired() {
+		s.lock.Unlock()
+		return lst.Close()
+	}
+	s.lst = lst
+	s.lock.Unlock()
+
+	log.Info("started")
+	for {
+		rawconn, err := lst.Accept()
+		if err != nil {
+			if errors.Is(err, ErrListenerClosed) {
+				return nil
+			}
+			log.Warn(err)
+			continue
+		}
+		if !s.track() {
+			rawconn.Close()
+			return nil
+		}
+		go func() {
+			defer s.wg.Done()
+			s.serve(rawconn)
+		}()
+	}
+}
+
+// track 记录一个新的连接协程，Shutdown之后返回false
+func (s *Server) track() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.quit.HasFired() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) serve(rawconn net.Conn) {
+	log := logger.WithFields(logger.Fields{
+		"module": "mem.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	})
+	conn := NewConn(rawconn)
+
+	session, err := sun.AcceptWithin(s.Acceptor, conn, s.options.loginwait)
+	if err != nil {
+		_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+		conn.Close()
+		return
+	}
+	channel := sun.NewChannel(session.ChannelID, conn)
+	channel.SetSession(session)
+	channel.SetReadWait(s.options.readwait)
+	channel.SetWriteWait(s.options.writewait)
+	if _, err = sun.AddWithPolicy(s.ChannelMap, channel, sun.DuplicateReject, nil); err != nil {
+		log.Warnf("channel %s rejected - %v", channel.ID(), err)
+		_ = channel.WriteFrame(sun.OpClose, []byte(err.Error()))
+		channel.Close()
+		return
+	}
+
+	err = channel.Readloop(s.MessageListener)
+	if err != nil {
+		log.Info(err)
+	}
+	// 只删除自己，不影响同一个channelId的其它连接
+	if s.CompareAndRemove(channel) {
+		_ = s.Disconnect(channel.Session())
+	}
+	channel.Close()
+	conn.Close()
+}
+
+// Shutdown 关闭监听并通知所有连接服务下线，等待连接协程执行完Disconnect，Start随后返回nil。
+// 在Start之前调用时，Start不会再开始监听
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.quit.Fire()
+		if s.lst != nil {
+			_ = s.lst.Close()
+		}
+		s.lock.Unlock()
+
+		sun.ShutdownChannels(ctx, s.ChannelMap, sun.CloseReasonShutdown)
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+// Push string channelID
+// []byte data
+func (s *Server) Push(id string, data []byte) error {
+	ch, ok := s.ChannelMap.Get(id)
+	if !ok {
+		return sun.ErrChannelNotFound
+	}
+	return ch.Push(data)
+}
+
+// Redirect 通知连接迁移到其它节点
+func (s *Server) Redirect(targets []string, window time.Duration, ids ...string) (int, error) {
+	return sun.RedirectChannels(s.ChannelMap, targets, window, ids...)
+}
+
+// PushToUser 推送消息到用户所有满足filters的在线设备
+func (s *Server) PushToUser(userID string, payload []byte, filters ...sun.DeviceFilter) (int, error) {
+	return sun.PushToUser(s.ChannelMap, userID, payload, filters...)
+}
+
+// Kick 踢掉用户所有满足filters的在线设备
+func (s *Server) Kick(userID string, reason string, filters ...sun.DeviceFilter) int {
+	return sun.KickUser(s.ChannelMap, userID, reason, filters...)
+}
+
+// Broadcast 推送消息到所有满足filters的连接
+func (s *Server) Broadcast(payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.BroadcastChannels(s.ChannelMap, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// PushMany 推送消息到ids中满足filters的连接
+func (s *Server) PushMany(ids []string, payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.PushChannels(s.ChannelMap, ids, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// SetAcceptor SetAcceptor
+func (s *Server) SetAcceptor(acceptor sun.Acceptor) {
+	s.Acceptor = acceptor
+}
+
+// SetMessageListener SetMessageListener
+func (s *Server) SetMessageListener(listener sun.MessageListener) {
+	s.MessageListener = listener
+}
+
+// SetStateListener SetStateListener
+func (s *Server) SetStateListener(listener sun.StateListener) {
+	s.StateListener = listener
+}
+
+// SetReadWait set read wait duration
+func (s *Server) SetReadWait(readwait time.Duration) {
+	s.options.readwait = readwait
+}
+
+// SetChannelMap SetChannelMap
+func (s *Server) SetChannelMap(channels sun.ChannelMap) {
+	s.ChannelMap = channels
+}
+
+type defaultAcceptor struct {
+}
+
+// Accept defaultAcceptor
+func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: ksuid.New().String()}, nil
+}
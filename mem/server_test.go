@@ -0,0 +1,174 @@
+package mem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+)
+
+type tokenAcceptor struct{}
+
+// Accept 读取Dialer发送的握手帧作为channelId
+func (a *tokenAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return &sun.Session{ChannelID: string(frame.GetPayload())}, nil
+}
+
+type echoListener struct{}
+
+func (l *echoListener) Receive(ag sun.Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func (l *echoListener) Disconnect(session *sun.Session) error {
+	return nil
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	srv := NewServer(t.Name(), &naming.DefaultService{Id: "mem01", Protocol: "mem"})
+	lst := new(echoListener)
+	srv.SetAcceptor(new(tokenAcceptor))
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+	defer func() {
+		_ = srv.Shutdown(context.Background())
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	cli := NewClient("u1", "test", ClientOptions{})
+	var err error
+	for i := 0; i < 100; i++ {
+		// 等待Server开始监听
+		if err = cli.Connect(t.Name()); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if err = cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(frame.GetPayload()); got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+	if err = srv.Push("u1", []byte("push")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err = cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(frame.GetPayload()); got != "push" {
+		t.Fatalf("got %q, want push", got)
+	}
+}
+
+func TestDialUnknown(t *testing.T) {
+	if _, err := DialConn("nobody"); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+// stateListener 记录Disconnect
+type stateListener struct {
+	echoListener
+	disconnected chan string
+}
+
+func (l *stateListener) Disconnect(session *sun.Session) error {
+	l.disconnected <- session.ChannelID
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	srv := NewServer(t.Name(), &naming.DefaultService{Id: "mem01", Protocol: "mem"})
+	lst := &stateListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(new(tokenAcceptor))
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+
+	cli := NewClient("u1", "test", ClientOptions{})
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = cli.Connect(t.Name()); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := srv.(*Server).Get("u1"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// net.Pipe没有缓冲，客户端需要读取Shutdown发送的OpClose帧
+	go func() {
+		for {
+			if _, err := cli.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown返回时Disconnect已经执行
+	select {
+	case id := <-lst.disconnected:
+		if id != "u1" {
+			t.Fatalf("disconnect %s, want u1", id)
+		}
+	default:
+		t.Fatal("Shutdown returned before Disconnect")
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	srv := NewServer(t.Name(), &naming.DefaultService{Id: "mem01", Protocol: "mem"})
+	srv.SetStateListener(new(echoListener))
+	_ = srv.Shutdown(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start should return after Shutdown")
+	}
+	if _, err := DialConn(t.Name()); err == nil {
+		t.Fatal("server should not be listening")
+	}
+}
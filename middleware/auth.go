@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	kim "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// Authorize 使用check校验请求，失败时返回 Unauthorized 并中止处理链
+func Authorize(check func(kim.Context) error) kim.HandlerFunc {
+	return func(ctx kim.Context) {
+		if err := check(ctx); err != nil {
+			ctx.Abort()
+			_ = ctx.RespWithError(pkt.Status_Unauthorized, err)
+			return
+		}
+		ctx.Next()
+	}
+}
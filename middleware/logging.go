@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"time"
+
+	kim "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/logger"
+)
+
+// Logging 记录每个指令的处理耗时
+func Logging() kim.HandlerFunc {
+	return func(ctx kim.Context) {
+		start := time.Now()
+		ctx.Next()
+		logger.WithFields(logger.Fields{
+			"module":  "middleware",
+			"command": ctx.Header().Command,
+			"id":      ctx.Agent().ID(),
+			"seq":     ctx.Header().Sequence,
+			"cost":    time.Since(start).String(),
+		}).Debug("handled")
+	}
+}
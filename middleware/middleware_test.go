@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	kim "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+type testAgent struct {
+	id     string
+	pushed [][]byte
+}
+
+func (a *testAgent) ID() string { return a.id }
+
+func (a *testAgent) Session() *kim.Session { return &kim.Session{ChannelID: a.id} }
+
+func (a *testAgent) Push(payload []byte) error {
+	a.pushed = append(a.pushed, payload)
+	return nil
+}
+
+func (a *testAgent) last(t *testing.T) *pkt.LogicPkt {
+	if len(a.pushed) == 0 {
+		t.Fatal("nothing pushed")
+	}
+	p, err := pkt.MustReadLogicPkt(bytes.NewReader(a.pushed[len(a.pushed)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRecover(t *testing.T) {
+	r := kim.NewRouter()
+	r.Use(Recover())
+	r.Handle("chat.user.talk", func(ctx kim.Context) {
+		panic("boom")
+	})
+
+	ag := &testAgent{id: "ch1"}
+	r.Receive(ag, pkt.Marshal(pkt.New("chat.user.talk")))
+	if resp := ag.last(t); resp.Status != pkt.Status_SystemException {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	called := false
+	r := kim.NewRouter()
+	r.Use(Authorize(func(ctx kim.Context) error {
+		if ctx.Header().ChannelId != "admin" {
+			return errors.New("denied")
+		}
+		return nil
+	}))
+	r.Handle("chat.user.talk", func(ctx kim.Context) {
+		called = true
+		_ = ctx.Resp(pkt.Status_Success, nil)
+	})
+
+	ag := &testAgent{id: "ch1"}
+	r.Receive(ag, pkt.Marshal(pkt.New("chat.user.talk")))
+	if called {
+		t.Fatal("handler should not be called after authorization failed")
+	}
+	if resp := ag.last(t); resp.Status != pkt.Status_Unauthorized || resp.StringBody() != "denied" {
+		t.Fatalf("unexpected response %v", &resp.Header)
+	}
+
+	admin := &testAgent{id: "admin"}
+	r.Receive(admin, pkt.Marshal(pkt.New("chat.user.talk")))
+	if !called || admin.last(t).Status != pkt.Status_Success {
+		t.Fatal("authorized request should be handled")
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	mark := func(name string) kim.HandlerFunc {
+		return func(ctx kim.Context) {
+			trace = append(trace, name+".before")
+			ctx.Next()
+			trace = append(trace, name+".after")
+		}
+	}
+	r := kim.NewRouter()
+	r.Use(Recover(), Logging(), mark("a"))
+	r.Handle("chat.user.talk", mark("b"), func(ctx kim.Context) {
+		trace = append(trace, "handler")
+	})
+
+	r.Receive(&testAgent{id: "ch1"}, pkt.Marshal(pkt.New("chat.user.talk")))
+	want := []string{"a.before", "b.before", "handler", "b.after", "a.after"}
+	if len(trace) != len(want) {
+		t.Fatalf("unexpected trace %v", trace)
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Fatalf("unexpected trace %v", trace)
+		}
+	}
+}
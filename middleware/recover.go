@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	kim "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// Recover 捕获处理函数中的panic，并给请求方返回 SystemException
+func Recover() kim.HandlerFunc {
+	return func(ctx kim.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				var callers []string
+				for i := 1; ; i++ {
+					_, file, line, got := runtime.Caller(i)
+					if !got {
+						break
+					}
+					callers = append(callers, fmt.Sprintf("%s:%d", file, line))
+				}
+				logger.WithFields(logger.Fields{
+					"module":  "middleware",
+					"command": ctx.Header().Command,
+					"id":      ctx.Agent().ID(),
+				}).Error(err, strings.Join(callers, "\n"))
+
+				ctx.Abort()
+				_ = ctx.RespWithError(pkt.Status_SystemException, errors.New("SystemException"))
+			}
+		}()
+		ctx.Next()
+	}
+}
@@ -63,7 +63,11 @@ func (e *DefaultService) PublicPort() int { return e.Port }
 // Protocol Protocol
 func (e *DefaultService) GetProtocol() string { return e.Protocol }
 
+// DialURL DialURL，Protocol为unix时Address为socket文件的路径
 func (e *DefaultService) DialURL() string {
+	if e.Protocol == "unix" {
+		return fmt.Sprintf("unix://%s", e.Address)
+	}
 	if e.Protocol == "tcp" {
 		return fmt.Sprintf("%s:%d", e.Address, e.Port)
 	}
@@ -0,0 +1,361 @@
+package polling
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// ClientConn 客户端的一个长轮询会话，实现了sun.Conn。
+// Flush时把缓冲区中的帧通过一个POST请求发送，ReadFrame通过GET请求拉取下行的帧
+type ClientConn struct {
+	address string
+	sid     string
+	httpcli *http.Client
+	frames  []sun.Frame // 上一次GET请求取回还没有被读取的帧
+	closed  *sun.Event
+
+	mu        sync.Mutex
+	wbuf      bytes.Buffer
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+// Dial 建立一个会话，handshake作为一个OpBinary帧交给服务端的Acceptor
+func Dial(address string, timeout time.Duration, handshake []byte) (*ClientConn, error) {
+	var body bytes.Buffer
+	if err := writeFrame(&body, sun.OpBinary, handshake); err != nil {
+		return nil, err
+	}
+	httpcli := &http.Client{}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, &body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpcli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("polling: handshake failed with %d %s", resp.StatusCode, reason)
+	}
+	return &ClientConn{
+		address: address,
+		sid:     resp.Header.Get(HeaderSessionID),
+		httpcli: httpcli,
+		closed:  sun.NewEvent(),
+	}, nil
+}
+
+// ReadFrame 返回下一个下行的帧，没有时发起GET请求等待服务端推送
+func (c *ClientConn) ReadFrame() (sun.Frame, error) {
+	for len(c.frames) == 0 {
+		if c.closed.HasFired() {
+			return nil, io.EOF
+		}
+		c.mu.Lock()
+		deadline := c.rdeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		if err := c.poll(deadline); err != nil {
+			return nil, err
+		}
+	}
+	frame := c.frames[0]
+	c.frames = c.frames[1:]
+	return frame, nil
+}
+
+func (c *ClientConn) poll(deadline time.Time) error {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	resp, err := c.do(ctx, http.MethodGet, nil)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.frames, err = readFrames(resp.Body, sun.DefaultMaxFrameSize)
+		return err
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		c.closed.Fire()
+		return io.EOF
+	default:
+		return fmt.Errorf("polling: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// WriteFrame 把帧写入缓冲区，调用Flush之后才会发送
+func (c *ClientConn) WriteFrame(code sun.OpCode, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeFrame(&c.wbuf, code, payload)
+}
+
+// Flush 通过一个POST请求发送缓冲区中所有的帧
+func (c *ClientConn) Flush() error {
+	c.mu.Lock()
+	if c.wbuf.Len() == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	body := make([]byte, c.wbuf.Len())
+	copy(body, c.wbuf.Bytes())
+	c.wbuf.Reset()
+	deadline := c.wdeadline
+	c.mu.Unlock()
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	resp, err := c.do(ctx, http.MethodPost, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("polling: send failed with %d %s", resp.StatusCode, reason)
+	}
+	return nil
+}
+
+func (c *ClientConn) do(ctx context.Context, method string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.address, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderSessionID, c.sid)
+	return c.httpcli.Do(req)
+}
+
+// Close 只关闭本地状态，需要通知服务端时先发送OpClose帧
+func (c *ClientConn) Close() error {
+	c.closed.Fire()
+	c.httpcli.CloseIdleConnections()
+	return nil
+}
+
+// Read 不支持
+func (c *ClientConn) Read(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// Write 不支持
+func (c *ClientConn) Write(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// LocalAddr LocalAddr
+func (c *ClientConn) LocalAddr() net.Addr {
+	return addr(c.sid)
+}
+
+// RemoteAddr RemoteAddr
+func (c *ClientConn) RemoteAddr() net.Addr {
+	return addr(c.address)
+}
+
+// SetDeadline SetDeadline
+func (c *ClientConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline SetReadDeadline
+func (c *ClientConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline SetWriteDeadline
+func (c *ClientConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// ClientOptions ClientOptions
+type ClientOptions struct {
+	ReadWait  time.Duration //读超时
+	WriteWait time.Duration //写超时
+}
+
+// Client 是http长轮询的Client实现，Connect的地址如 http://127.0.0.1:8000/
+type Client struct {
+	sync.Mutex
+	sun.Dialer
+	once    sync.Once
+	id      string
+	name    string
+	conn    *ClientConn
+	state   int32
+	options ClientOptions
+}
+
+// NewClient NewClient，默认使用Dialer完成握手
+func NewClient(id, name string, opts ClientOptions) sun.Client {
+	if opts.WriteWait == 0 {
+		opts.WriteWait = sun.DefaultWriteWait
+	}
+	if opts.ReadWait == 0 {
+		opts.ReadWait = sun.DefaultReadWait
+	}
+	return &Client{
+		Dialer:  new(Dialer),
+		id:      id,
+		name:    name,
+		options: opts,
+	}
+}
+
+// ID return id
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Name Name
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Connect to server
+func (c *Client) Connect(addr string) error {
+	if !atomic.CompareAndSwapInt32(&c.state, 0, 1) {
+		return fmt.Errorf("client has connected")
+	}
+	rawconn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
+		Id:      c.id,
+		Name:    c.name,
+		Address: addr,
+		Timeout: sun.DefaultLoginWait,
+	})
+	if err != nil {
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
+		return err
+	}
+	conn, ok := rawconn.(*ClientConn)
+	if !ok {
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
+		return errors.New("polling: Dialer must return a *polling.ClientConn")
+	}
+	c.conn = conn
+	return nil
+}
+
+// SetDialer 设置握手逻辑
+func (c *Client) SetDialer(dialer sun.Dialer) {
+	c.Dialer = dialer
+}
+
+// Send data to connection
+func (c *Client) Send(payload []byte) error {
+	if atomic.LoadInt32(&c.state) == 0 {
+		return fmt.Errorf("connection is nil")
+	}
+	c.Lock()
+	defer c.Unlock()
+	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	if err != nil {
+		return err
+	}
+	if err = c.conn.WriteFrame(sun.OpBinary, payload); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
+// SendPkt 序列化消息包并发送
+func (c *Client) SendPkt(p pkt.Packet) error {
+	return c.Send(pkt.Marshal(p))
+}
+
+// Close 关闭
+func (c *Client) Close() {
+	c.once.Do(func() {
+		if c.conn == nil {
+			return
+		}
+		// graceful close connection
+		c.Lock()
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+		_ = c.conn.WriteFrame(sun.OpClose, nil)
+		_ = c.conn.Flush()
+		c.Unlock()
+
+		c.conn.Close()
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
+	})
+}
+
+func (c *Client) Read() (sun.Frame, error) {
+	if c.conn == nil {
+		return nil, errors.New("connection is nil")
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+	frame, err := c.conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frame.GetOpCode() == sun.OpClose {
+		return nil, errors.New("remote side close the channel")
+	}
+	return frame, nil
+}
+
+// ReadPkt 读取并解码一个消息包，控制帧会被跳过
+func (c *Client) ReadPkt() (interface{}, error) {
+	for {
+		frame, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if frame.GetOpCode() != sun.OpBinary {
+			continue
+		}
+		return pkt.Read(bytes.NewReader(frame.GetPayload()))
+	}
+}
+
+// Dialer 建立会话，把ctx.Id作为握手帧发送给服务端的Acceptor
+type Dialer struct {
+}
+
+// DialAndHandshake DialAndHandshake
+func (d *Dialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
+	return Dial(ctx.Address, ctx.Timeout, []byte(ctx.Id))
+}
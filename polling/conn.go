@@ -0,0 +1,299 @@
+package polling
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+// errors
+var (
+	ErrSessionClosed   = errors.New("polling: session closed")
+	ErrPendingOverflow = errors.New("polling: too many pending frames, client stopped polling")
+	errNotSupported    = errors.New("polling: raw read/write is not supported, use ReadFrame/WriteFrame")
+)
+
+// Frame Frame
+type Frame struct {
+	OpCode  sun.OpCode
+	Payload []byte
+}
+
+// SetOpCode SetOpCode
+func (f *Frame) SetOpCode(code sun.OpCode) {
+	f.OpCode = code
+}
+
+// GetOpCode GetOpCode
+func (f *Frame) GetOpCode() sun.OpCode {
+	return f.OpCode
+}
+
+// SetPayload SetPayload
+func (f *Frame) SetPayload(payload []byte) {
+	f.Payload = payload
+}
+
+// GetPayload GetPayload
+func (f *Frame) GetPayload() []byte {
+	return f.Payload
+}
+
+// writeFrame 请求与响应的body使用与tcp相同的 [opcode u8][len u32][payload] 帧格式，
+// 一个body中可以包含多个帧
+func writeFrame(w io.Writer, code sun.OpCode, payload []byte) error {
+	if err := endian.WriteUint8(w, uint8(code)); err != nil {
+		return err
+	}
+	return endian.WriteBytes(w, payload)
+}
+
+// readFrame 读取一个帧，body读完时返回io.EOF
+func readFrame(r io.Reader, maxFrameSize int) (*Frame, error) {
+	opcode, err := endian.ReadUint8(r)
+	if err != nil {
+		return nil, err
+	}
+	length, err := endian.ReadUint32(r)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uint64(length) > uint64(maxFrameSize) {
+		return nil, fmt.Errorf("%w: %d exceeds limit %d", sun.ErrFrameTooLarge, length, maxFrameSize)
+	}
+	payload, err := endian.ReadFixedBytes(int(length), r)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{OpCode: sun.OpCode(opcode), Payload: payload}, nil
+}
+
+// Conn 服务端的一个长轮询会话，实现了sun.Conn，因此可以直接交给sun.NewChannel。
+// 上行的帧由POST请求投递，ReadFrame读取；下行的帧在Flush之后等待GET请求取走
+type Conn struct {
+	sid        string
+	local      net.Addr
+	remote     net.Addr
+	maxPending int
+	uplink     chan sun.Frame
+	notify     chan struct{}
+	touched    chan struct{} // GET请求到达，ReadFrame重新计算超时
+	closed     *sun.Event
+
+	mu        sync.Mutex
+	wbuf      bytes.Buffer // 还没有Flush的帧
+	pending   bytes.Buffer // 等待GET取走的帧
+	rdeadline time.Time
+	readwait  time.Duration // 最近一次SetReadDeadline的等待时间，touch时从当前时间重新计算
+}
+
+func newConn(sid string, local, remote net.Addr, maxPending int) *Conn {
+	return &Conn{
+		sid:        sid,
+		local:      local,
+		remote:     remote,
+		maxPending: maxPending,
+		uplink:     make(chan sun.Frame, 16),
+		notify:     make(chan struct{}, 1),
+		touched:    make(chan struct{}, 1),
+		closed:     sun.NewEvent(),
+	}
+}
+
+// SessionID 会话ID，客户端在后续的请求中通过HeaderSessionID携带
+func (c *Conn) SessionID() string {
+	return c.sid
+}
+
+// ReadFrame 读取一个上行的帧，会话关闭后返回io.EOF。
+// 下行的GET请求同样证明客户端存活，每次到达时读超时从当前时间重新计算
+func (c *Conn) ReadFrame() (sun.Frame, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.rdeadline
+		c.mu.Unlock()
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case frame := <-c.uplink:
+			stopTimer(timer)
+			return frame, nil
+		case <-c.closed.Done():
+			stopTimer(timer)
+			return nil, io.EOF
+		case <-c.touched:
+			stopTimer(timer)
+		case <-timeout:
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// touch 收到GET请求时延长读超时
+func (c *Conn) touch() {
+	c.mu.Lock()
+	if !c.rdeadline.IsZero() {
+		c.rdeadline = time.Now().Add(c.readwait)
+	}
+	c.mu.Unlock()
+	select {
+	case c.touched <- struct{}{}:
+	default:
+	}
+}
+
+// WriteFrame 把帧写入缓冲区，调用Flush之后才能被GET请求取走
+func (c *Conn) WriteFrame(code sun.OpCode, payload []byte) error {
+	if c.closed.HasFired() {
+		return ErrSessionClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeFrame(&c.wbuf, code, payload)
+}
+
+// Flush 把缓冲区中的帧交给等待中的GET请求。
+// 客户端长时间不来取时积压会超过maxPending，此时关闭会话
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	if c.pending.Len()+c.wbuf.Len() > c.maxPending {
+		c.wbuf.Reset()
+		c.mu.Unlock()
+		c.Close()
+		return ErrPendingOverflow
+	}
+	_, _ = c.wbuf.WriteTo(&c.pending)
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deliver 投递一个上行的帧，队列满时阻塞，从而对客户端形成背压
+func (c *Conn) deliver(done <-chan struct{}, frame sun.Frame) error {
+	select {
+	case c.uplink <- frame:
+		return nil
+	case <-c.closed.Done():
+		return ErrSessionClosed
+	case <-done:
+		return ErrSessionClosed
+	}
+}
+
+// poll 取走所有已经Flush的帧，没有时最多等待timeout。
+// 会话已经关闭并且没有剩余的帧时返回false
+func (c *Conn) poll(done <-chan struct{}, timeout time.Duration) ([]byte, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if c.pending.Len() > 0 {
+			buf := make([]byte, c.pending.Len())
+			copy(buf, c.pending.Bytes())
+			c.pending.Reset()
+			c.mu.Unlock()
+			return buf, true
+		}
+		c.mu.Unlock()
+		if c.closed.HasFired() {
+			return nil, false
+		}
+		select {
+		case <-c.notify:
+		case <-c.closed.Done():
+		case <-done:
+			return nil, true
+		case <-timer.C:
+			return nil, true
+		}
+	}
+}
+
+// buffered 还没有被GET取走的字节数
+func (c *Conn) buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending.Len()
+}
+
+// Close 关闭会话，已经Flush的帧仍然可以被下一个GET请求取走
+func (c *Conn) Close() error {
+	c.closed.Fire()
+	return nil
+}
+
+// Read 不支持
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// Write 不支持
+func (c *Conn) Write(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// LocalAddr LocalAddr
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr 发起会话的http请求的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline SetDeadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline 控制ReadFrame的等待时间，客户端超过readwait既没有上行消息也没有GET请求时会话超时
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	if !t.IsZero() {
+		c.readwait = time.Until(t)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 写入只是进入缓冲区，不会阻塞
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// addr 实现net.Addr
+type addr string
+
+func (a addr) Network() string { return "http" }
+
+func (a addr) String() string { return string(a) }
@@ -0,0 +1,473 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/naming"
+)
+
+// HeaderSessionID 建立会话之后，服务端在响应头中返回会话ID，
+// 客户端之后的POST与GET请求都要携带它
+const HeaderSessionID = "X-Session-Id"
+
+// DefaultPollTimeout 一个GET请求最长的挂起时间，需要小于代理的空闲超时
+const DefaultPollTimeout = time.Second * 25
+
+// DefaultMaxPendingSize 等待客户端取走的下行数据的最大长度
+const DefaultMaxPendingSize = 4 * 1024 * 1024
+
+// ServerOptions ServerOptions
+type ServerOptions struct {
+	loginwait    time.Duration //登陆超时
+	readwait     time.Duration //读超时
+	writewait    time.Duration //写超时
+	pollTimeout  time.Duration //GET请求最长的挂起时间
+	maxFrameSize int           //单个帧payload的最大长度
+	maxPending   int           //积压的下行数据的最大长度
+	path         string        //长轮询的路径
+}
+
+// ServerOption ServerOption
+type ServerOption func(*ServerOptions)
+
+// WithPath 设置长轮询的路径，默认为 /
+func WithPath(path string) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.path = path
+	}
+}
+
+// WithPollTimeout 设置GET请求最长的挂起时间，超时之后返回204，客户端重新发起请求
+func WithPollTimeout(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.pollTimeout = timeout
+	}
+}
+
+// WithMaxFrameSize 设置单个帧payload的最大长度，超过时关闭会话
+func WithMaxFrameSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxFrameSize = size
+	}
+}
+
+// WithMaxPendingSize 设置积压的下行数据的最大长度，超过时关闭会话
+func WithMaxPendingSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxPending = size
+	}
+}
+
+// Server 是http长轮询的Server实现，用于websocket升级被代理拦截的网络环境。
+//
+//   - POST 不带HeaderSessionID：建立会话，body中的帧交给Acceptor
+//   - POST 带HeaderSessionID：上行消息，body中可以包含多个帧
+//   - GET  带HeaderSessionID：挂起直到有下行消息或者超时
+//
+// 会话实现了sun.Conn，Channel、ChannelMap以及各个Listener与websocket完全相同。
+// 下行消息在GET响应写出之后即被丢弃，响应失败的消息不会重发
+type Server struct {
+	listen string
+	naming.ServiceRegistration
+	sun.ChannelMap
+	sun.Acceptor
+	sun.MessageListener
+	sun.StateListener
+	once     sync.Once
+	options  ServerOptions
+	httpsrv  *http.Server
+	sessions sync.Map // sid -> *Conn
+	quit     *sun.Event
+	lock     sync.Mutex     // 保证Shutdown之后不再增加wg
+	wg       sync.WaitGroup // 会话的Readloop协程，Shutdown等待它们执行完Disconnect
+}
+
+// NewServer NewServer
+func NewServer(listen string, service naming.ServiceRegistration, options ...ServerOption) sun.Server {
+	opts := ServerOptions{
+		loginwait:    sun.DefaultLoginWait,
+		readwait:     sun.DefaultReadWait,
+		writewait:    sun.DefaultWriteWait,
+		pollTimeout:  DefaultPollTimeout,
+		maxFrameSize: sun.DefaultMaxFrameSize,
+		maxPending:   DefaultMaxPendingSize,
+		path:         "/",
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	s := &Server{
+		listen:              listen,
+		ServiceRegistration: service,
+		options:             opts,
+		quit:                sun.NewEvent(),
+		httpsrv: &http.Server{
+			Addr:              listen,
+			ReadHeaderTimeout: sun.DefaultLoginWait,
+		},
+	}
+	// http.Server.Shutdown会等待挂起的GET请求，先关闭会话让它们立即返回
+	s.httpsrv.RegisterOnShutdown(s.closeSessions)
+	return s
+}
+
+// Start server
+func (s *Server) Start() error {
+	log := logger.WithFields(logger.Fields{
+		"module": "polling.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	})
+
+	if s.Acceptor == nil {
+		s.Acceptor = new(defaultAcceptor)
+	}
+	if s.StateListener == nil {
+		return fmt.Errorf("StateListener is nil")
+	}
+	if s.ChannelMap == nil {
+		s.ChannelMap = sun.NewChannels(100)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.options.path, func(w http.ResponseWriter, r *http.Request) {
+		sid := r.Header.Get(HeaderSessionID)
+		switch {
+		case r.Method == http.MethodPost && sid == "":
+			s.open(w, r)
+		case r.Method == http.MethodPost:
+			s.uplink(w, r, sid)
+		case r.Method == http.MethodGet && sid != "":
+			s.downlink(w, r, sid)
+		default:
+			resp(w, http.StatusMethodNotAllowed, "")
+		}
+	})
+	s.httpsrv.Handler = mux
+
+	log.Infoln("started")
+	err := s.httpsrv.ListenAndServe()
+	// 调用Shutdown之后正常退出
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// open 建立会话并完成握手
+func (s *Server) open(w http.ResponseWriter, r *http.Request) {
+	log := logger.WithFields(logger.Fields{
+		"module": "polling.server",
+		"id":     s.ServiceID(),
+	})
+	// step 1 握手的帧由Acceptor读取
+	body := http.MaxBytesReader(w, r.Body, int64(s.options.maxFrameSize)+5)
+	frames, err := readFrames(body, s.options.maxFrameSize)
+	if err != nil {
+		resp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn := newConn(ksuid.New().String(), addr(r.Host), addr(r.RemoteAddr), s.options.maxPending)
+	go func() {
+		for _, frame := range frames {
+			if conn.deliver(nil, frame) != nil {
+				return
+			}
+		}
+	}()
+
+	// step 2
+	session, err := sun.AcceptWithin(s.Acceptor, conn, s.options.loginwait)
+	if err != nil {
+		conn.Close()
+		resp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !s.track() {
+		conn.Close()
+		resp(w, http.StatusServiceUnavailable, sun.CloseReasonShutdown)
+		return
+	}
+	// step 3
+	channel := sun.NewChannel(session.ChannelID, conn)
+	channel.SetSession(session)
+	channel.SetWriteWait(s.options.writewait)
+	channel.SetReadWait(s.options.readwait)
+	if _, err = sun.AddWithPolicy(s.ChannelMap, channel, sun.DuplicateReject, nil); err != nil {
+		log.Warnf("channel %s rejected - %v", channel.ID(), err)
+		channel.Close()
+		s.wg.Done()
+		resp(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.sessions.Store(conn.SessionID(), conn)
+
+	go func(ch sun.Channel) {
+		defer s.wg.Done()
+		// step 4
+		err := ch.Readloop(s.MessageListener)
+		if err != nil {
+			log.Info(err)
+		}
+		// step 5
+		if s.CompareAndRemove(ch) {
+			err = s.Disconnect(ch.Session())
+			if err != nil {
+				log.Warn(err)
+			}
+		}
+		ch.Close()
+		conn.Close()
+		// 留给客户端一个poll周期取走剩余的帧，比如关闭原因
+		time.AfterFunc(s.options.pollTimeout, func() {
+			s.sessions.Delete(conn.SessionID())
+		})
+	}(channel)
+
+	w.Header().Set(HeaderSessionID, conn.SessionID())
+	w.WriteHeader(http.StatusOK)
+}
+
+// uplink 把body中的帧依次投递给会话
+func (s *Server) uplink(w http.ResponseWriter, r *http.Request, sid string) {
+	conn, ok := s.session(sid)
+	if !ok {
+		resp(w, http.StatusNotFound, "session not found")
+		return
+	}
+	for {
+		frame, err := readFrame(r.Body, s.options.maxFrameSize)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, sun.ErrFrameTooLarge) {
+			_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+			_ = conn.Flush()
+			conn.Close()
+			resp(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			resp(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err = conn.deliver(r.Context().Done(), frame); err != nil {
+			resp(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// downlink 挂起直到有下行的帧，超时返回204
+func (s *Server) downlink(w http.ResponseWriter, r *http.Request, sid string) {
+	conn, ok := s.session(sid)
+	if !ok {
+		resp(w, http.StatusNotFound, "session not found")
+		return
+	}
+	conn.touch()
+	buf, alive := conn.poll(r.Context().Done(), s.options.pollTimeout)
+	if len(buf) == 0 {
+		if !alive {
+			resp(w, http.StatusNotFound, ErrSessionClosed.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(buf)
+}
+
+func (s *Server) session(sid string) (*Conn, bool) {
+	val, ok := s.sessions.Load(sid)
+	if !ok {
+		return nil, false
+	}
+	return val.(*Conn), true
+}
+
+func (s *Server) closeSessions() {
+	s.sessions.Range(func(key, val interface{}) bool {
+		val.(*Conn).Close()
+		return true
+	})
+}
+
+// track 记录一个会话的Readloop协程，Shutdown之后返回false
+func (s *Server) track() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.quit.HasFired() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// waitDrained 等待所有会话中积压的帧被GET取走，最多等待pollTimeout
+func (s *Server) waitDrained(ctx context.Context) {
+	deadline := time.NewTimer(s.options.pollTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(time.Millisecond * 10)
+	defer tick.Stop()
+	for {
+		drained := true
+		s.sessions.Range(func(key, val interface{}) bool {
+			drained = val.(*Conn).buffered() == 0
+			return drained
+		})
+		if drained {
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown 通知所有会话服务下线，在ctx到期之前把队列中的消息与OpClose帧交给客户端，
+// 等待所有会话回调Disconnect之后再停止监听，挂起的GET请求会取走剩余的帧
+func (s *Server) Shutdown(ctx context.Context) error {
+	log := logger.WithFields(logger.Fields{
+		"module": "polling.server",
+		"id":     s.ServiceID(),
+	})
+	var err error
+	s.once.Do(func() {
+		defer func() {
+			log.Infoln("shutdown")
+		}()
+		s.lock.Lock()
+		s.quit.Fire()
+		s.lock.Unlock()
+
+		if s.ChannelMap != nil {
+			sun.ShutdownChannels(ctx, s.ChannelMap, sun.CloseReasonShutdown)
+		}
+		// 等待Readloop协程执行完Disconnect
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		// 最多再等待一个poll周期，让客户端取走剩余的帧与关闭原因
+		s.waitDrained(ctx)
+		// 停止监听，还在握手中的会话由closeSessions关闭
+		if serr := s.httpsrv.Shutdown(ctx); err == nil {
+			err = serr
+		}
+	})
+	return err
+}
+
+// Push string channelID
+// []byte data
+func (s *Server) Push(id string, data []byte) error {
+	ch, ok := s.ChannelMap.Get(id)
+	if !ok {
+		return sun.ErrChannelNotFound
+	}
+	return ch.Push(data)
+}
+
+// Redirect 通知连接迁移到其它节点
+func (s *Server) Redirect(targets []string, window time.Duration, ids ...string) (int, error) {
+	return sun.RedirectChannels(s.ChannelMap, targets, window, ids...)
+}
+
+// PushToUser 推送消息到用户所有满足filters的在线设备
+func (s *Server) PushToUser(userID string, payload []byte, filters ...sun.DeviceFilter) (int, error) {
+	return sun.PushToUser(s.ChannelMap, userID, payload, filters...)
+}
+
+// Kick 踢掉用户所有满足filters的在线设备
+func (s *Server) Kick(userID string, reason string, filters ...sun.DeviceFilter) int {
+	return sun.KickUser(s.ChannelMap, userID, reason, filters...)
+}
+
+// Broadcast 推送消息到所有满足filters的连接
+func (s *Server) Broadcast(payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.BroadcastChannels(s.ChannelMap, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// PushMany 推送消息到ids中满足filters的连接
+func (s *Server) PushMany(ids []string, payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.PushChannels(s.ChannelMap, ids, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// SetAcceptor SetAcceptor
+func (s *Server) SetAcceptor(acceptor sun.Acceptor) {
+	s.Acceptor = acceptor
+}
+
+// SetMessageListener SetMessageListener
+func (s *Server) SetMessageListener(listener sun.MessageListener) {
+	s.MessageListener = listener
+}
+
+// SetStateListener SetStateListener
+func (s *Server) SetStateListener(listener sun.StateListener) {
+	s.StateListener = listener
+}
+
+// SetChannelMap SetChannelMap
+func (s *Server) SetChannelMap(channels sun.ChannelMap) {
+	s.ChannelMap = channels
+}
+
+// SetReadWait set read wait duration
+func (s *Server) SetReadWait(readwait time.Duration) {
+	s.options.readwait = readwait
+}
+
+// readFrames 读取body中所有的帧
+func readFrames(r io.Reader, maxFrameSize int) ([]sun.Frame, error) {
+	var frames []sun.Frame
+	for {
+		frame, err := readFrame(r, maxFrameSize)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func resp(w http.ResponseWriter, code int, body string) {
+	w.WriteHeader(code)
+	if body != "" {
+		_, _ = w.Write([]byte(body))
+	}
+	logger.Warnf("response with code:%d %s", code, body)
+}
+
+type defaultAcceptor struct {
+}
+
+// Accept defaultAcceptor
+func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: ksuid.New().String()}, nil
+}
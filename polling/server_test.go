@@ -0,0 +1,175 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+)
+
+type tokenAcceptor struct{}
+
+// Accept 读取Dialer发送的握手帧作为channelId
+func (a *tokenAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if string(frame.GetPayload()) == "" {
+		return nil, errors.New("token is required")
+	}
+	return &sun.Session{ChannelID: string(frame.GetPayload())}, nil
+}
+
+type echoListener struct {
+	disconnected chan string
+}
+
+func (l *echoListener) Receive(ag sun.Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func (l *echoListener) Disconnect(session *sun.Session) error {
+	l.disconnected <- session.ChannelID
+	return nil
+}
+
+func startServer(t *testing.T) (sun.Server, string, *echoListener) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lst.Addr().String()
+	lst.Close()
+
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"},
+		WithPath("/poll"), WithPollTimeout(time.Millisecond*100))
+	listener := &echoListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(new(tokenAcceptor))
+	srv.SetMessageListener(listener)
+	srv.SetStateListener(listener)
+	go func() {
+		_ = srv.Start()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown(context.Background())
+	})
+	time.Sleep(time.Millisecond * 100)
+	return srv, "http://" + addr + "/poll", listener
+}
+
+func TestLongPolling(t *testing.T) {
+	_, url, listener := startServer(t)
+
+	cli := NewClient("u1", "test", ClientOptions{})
+	if err := cli.Connect(url); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// 经过几个空的poll周期之后仍然能收到消息
+	time.Sleep(time.Millisecond * 300)
+	frame, err := cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(frame.GetPayload()); got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+
+	cli.Close()
+	select {
+	case id := <-listener.disconnected:
+		if id != "u1" {
+			t.Fatalf("disconnect %s, want u1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	_, url, _ := startServer(t)
+
+	_, err := Dial(url, time.Second, nil)
+	if err == nil {
+		t.Fatal("expect handshake error")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv, url, listener := startServer(t)
+
+	conn, err := Dial(url, time.Second, []byte("u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		if err = srv.Push("u1", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(ctx)
+	}()
+
+	// 队列中的消息都会送达，最后是带有原因的OpClose帧
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for i := 0; i < 10; i++ {
+		frame, err := conn.ReadFrame()
+		if err != nil || string(frame.GetPayload()) != "hello" {
+			t.Fatalf("frame %d: %v %v", i, frame, err)
+		}
+	}
+	frame, err := conn.ReadFrame()
+	if err != nil || frame.GetOpCode() != sun.OpClose || string(frame.GetPayload()) != sun.CloseReasonShutdown {
+		t.Fatalf("unexpected frame %v %v", frame, err)
+	}
+	select {
+	case id := <-listener.disconnected:
+		if id != "u1" {
+			t.Fatalf("disconnect %s, want u1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleSession(t *testing.T) {
+	srv, url, listener := startServer(t)
+	srv.SetReadWait(time.Millisecond * 300)
+
+	conn, err := Dial(url, time.Second, []byte("u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 只接收消息的客户端没有上行，GET请求让会话保持存活
+	time.AfterFunc(time.Millisecond*900, func() {
+		_ = srv.Push("u1", []byte("hello"))
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	frame, err := conn.ReadFrame()
+	if err != nil || string(frame.GetPayload()) != "hello" {
+		t.Fatalf("unexpected frame %v %v", frame, err)
+	}
+	select {
+	case id := <-listener.disconnected:
+		t.Fatalf("idle session %s is disconnected", id)
+	default:
+	}
+}
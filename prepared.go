@@ -0,0 +1,76 @@
+package kim
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrWriteQueueFull 发送队列已满，TryPush不会等待
+var ErrWriteQueueFull = errors.New("write queue is full")
+
+// PreparedFrame 一个需要推送给多个连接的OpBinary帧。
+// 协议与编码参数相同的连接共享同一份编码结果，广播时每种编码只执行一次
+type PreparedFrame struct {
+	payload []byte
+	mu      sync.Mutex
+	frames  map[interface{}]*preparedData
+}
+
+type preparedData struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// NewPreparedFrame payload在所有连接之间共享，推送之后不能再修改
+func NewPreparedFrame(payload []byte) *PreparedFrame {
+	return &PreparedFrame{
+		payload: payload,
+		frames:  make(map[interface{}]*preparedData),
+	}
+}
+
+// Payload 返回未编码的payload
+func (f *PreparedFrame) Payload() []byte {
+	return f.payload
+}
+
+// Encode 返回key对应的编码结果，同一个key的encode只会执行一次。
+// key由Conn的实现决定，需要包含影响编码结果的所有参数并且可以比较
+func (f *PreparedFrame) Encode(key interface{}, encode func(payload []byte) ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	d, ok := f.frames[key]
+	if !ok {
+		d = &preparedData{}
+		f.frames[key] = d
+	}
+	f.mu.Unlock()
+	d.once.Do(func() {
+		d.data, d.err = encode(f.payload)
+	})
+	return d.data, d.err
+}
+
+// PreparedWriter 可以直接写入PreparedFrame编码结果的Conn，
+// 没有实现它的Conn按普通的OpBinary帧写入
+type PreparedWriter interface {
+	// WritePrepared 与WriteFrame相同，写入的数据需要调用Flush才会发送
+	WritePrepared(*PreparedFrame) error
+}
+
+// writeMessage 把一个待发送的消息写入conn的缓冲区
+func writeMessage(conn Conn, msg message) error {
+	if msg.prepared == nil {
+		return conn.WriteFrame(OpBinary, msg.payload)
+	}
+	if w, ok := conn.(PreparedWriter); ok {
+		return w.WritePrepared(msg.prepared)
+	}
+	return conn.WriteFrame(OpBinary, msg.prepared.Payload())
+}
+
+// message 发送队列中的一个消息，Push时只有payload，TryPush时只有prepared
+type message struct {
+	payload  []byte
+	prepared *PreparedFrame
+}
@@ -0,0 +1,269 @@
+// Package proxyproto 解析HAProxy PROXY protocol v1/v2的头部，
+// 部署在四层负载均衡之后时用于获取客户端的真实地址。
+// 只能在可信的负载均衡之后开启，否则客户端可以伪造自己的地址
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Mode 是否解析PROXY protocol头部
+type Mode int
+
+// modes
+const (
+	// ModeOff 不解析，默认值
+	ModeOff Mode = iota
+	// ModeOptional 有头部时解析，没有时使用连接本身的地址
+	ModeOptional
+	// ModeRequired 必须有头部，否则关闭连接
+	ModeRequired
+)
+
+// errors
+var (
+	ErrNoHeader      = errors.New("proxyproto: PROXY protocol header is required")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+// v1的头部最长107个字节
+const maxV1Length = 107
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Listener 包装net.Listener，Accept返回的连接在第一次读取或者获取地址时解析头部
+type Listener struct {
+	net.Listener
+	mode    Mode
+	timeout time.Duration
+}
+
+// NewListener NewListener，timeout为读取头部的超时时间
+func NewListener(lst net.Listener, mode Mode, timeout time.Duration) net.Listener {
+	if mode == ModeOff {
+		return lst
+	}
+	return &Listener{
+		Listener: lst,
+		mode:     mode,
+		timeout:  timeout,
+	}
+}
+
+// Accept Accept
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.mode, l.timeout), nil
+}
+
+// Conn 解析头部之后，RemoteAddr与LocalAddr返回头部中的源地址与目的地址。
+// 头部是逐字节精确读取的，ModeRequired不会把后续的数据缓存在用户态，因此可以与netpoll一起使用；
+// ModeOptional在没有头部时，已经读取的最多12个字节保存在prefix中由Read先返回，不能绕过Read读取fd
+type Conn struct {
+	net.Conn
+	mode    Mode
+	timeout time.Duration
+	once    sync.Once
+	err     error
+	remote  net.Addr
+	local   net.Addr
+	prefix  []byte // 可选模式下没有头部时，已经读取的数据
+}
+
+// NewConn NewConn
+func NewConn(conn net.Conn, mode Mode, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		mode:    mode,
+		timeout: timeout,
+	}
+}
+
+// Handshake 读取并解析头部，重复调用返回第一次的结果。
+// Read、RemoteAddr与LocalAddr会自动调用它
+func (c *Conn) Handshake() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer func() {
+				_ = c.Conn.SetReadDeadline(time.Time{})
+			}()
+		}
+		c.err = c.readHeader()
+	})
+	return c.err
+}
+
+func (c *Conn) readHeader() error {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(c.Conn, first); err != nil {
+		return err
+	}
+	var sig []byte
+	switch first[0] {
+	case v1Prefix[0]:
+		sig = v1Prefix
+	case v2Signature[0]:
+		sig = v2Signature
+	default:
+		return c.noHeader(first)
+	}
+	buf := make([]byte, len(sig))
+	buf[0] = first[0]
+	if _, err := io.ReadFull(c.Conn, buf[1:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, sig) {
+		return c.noHeader(buf)
+	}
+	if first[0] == v1Prefix[0] {
+		return c.readV1()
+	}
+	return c.readV2()
+}
+
+func (c *Conn) noHeader(read []byte) error {
+	if c.mode == ModeRequired {
+		return ErrNoHeader
+	}
+	c.prefix = read
+	return nil
+}
+
+// readV1 PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (c *Conn) readV1() error {
+	line := make([]byte, 0, maxV1Length)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) > maxV1Length-len(v1Prefix) {
+			return ErrInvalidHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidHeader
+	}
+	fields := strings.Fields(string(line))
+	// UNKNOWN之后的内容需要被忽略，使用连接本身的地址
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[1], fields[3])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, fmt.Errorf("%w: %s:%s", ErrInvalidHeader, ip, port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readV2 [signature 12][ver_cmd 1][fam 1][len 2][addresses][tlv]
+func (c *Conn) readV2() error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, head); err != nil {
+		return err
+	}
+	if head[0]>>4 != 2 {
+		return fmt.Errorf("%w: version %d", ErrInvalidHeader, head[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		return err
+	}
+	// LOCAL命令是负载均衡自身的健康检查，使用连接本身的地址
+	if head[0]&0x0f == 0 {
+		return nil
+	}
+	switch head[1] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return ErrInvalidHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return ErrInvalidHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	default:
+		// 其它地址族(如unix)不改变地址
+	}
+	return nil
+}
+
+// Read 先返回可选模式下已经读取的数据
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr 客户端的真实地址，没有头部时为连接本身的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Handshake() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 客户端连接的目的地址，没有头部时为连接本身的地址
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Handshake() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SyscallConn 返回底层连接的fd，用于netpoll
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("proxyproto: underlying conn is not a syscall.Conn")
+	}
+	return sc.SyscallConn()
+}
@@ -0,0 +1,88 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func pipe(t *testing.T, mode Mode, header []byte, payload string) *Conn {
+	cli, srv := net.Pipe()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	go func() {
+		_, _ = cli.Write(append(header, payload...))
+	}()
+	return NewConn(srv, mode, time.Second)
+}
+
+func expectPayload(t *testing.T, conn *Conn, payload string) {
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != payload {
+		t.Fatalf("got %q, want %q", buf, payload)
+	}
+}
+
+func TestV1(t *testing.T) {
+	conn := pipe(t, ModeRequired, []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 8000\r\n"), "hello")
+	if got := conn.RemoteAddr().String(); got != "192.168.0.1:56324" {
+		t.Fatalf("remote addr %s", got)
+	}
+	if got := conn.LocalAddr().String(); got != "10.0.0.1:8000" {
+		t.Fatalf("local addr %s", got)
+	}
+	expectPayload(t, conn, "hello")
+}
+
+func TestV1Unknown(t *testing.T) {
+	// UNKNOWN之后的地址需要被忽略
+	for _, header := range []string{
+		"PROXY UNKNOWN\r\n",
+		"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n",
+	} {
+		conn := pipe(t, ModeRequired, []byte(header), "hello")
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("%q: %v", header, err)
+		}
+		if got := conn.RemoteAddr(); got != conn.Conn.RemoteAddr() {
+			t.Fatalf("%q: remote addr %s", header, got)
+		}
+		expectPayload(t, conn, "hello")
+	}
+}
+
+func TestV2(t *testing.T) {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 192, 168, 0, 1, 10, 0, 0, 1, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-4:], 56324)
+	binary.BigEndian.PutUint16(header[len(header)-2:], 8000)
+
+	conn := pipe(t, ModeOptional, header, "hello")
+	if got := conn.RemoteAddr().String(); got != "192.168.0.1:56324" {
+		t.Fatalf("remote addr %s", got)
+	}
+	expectPayload(t, conn, "hello")
+}
+
+func TestOptionalWithoutHeader(t *testing.T) {
+	conn := pipe(t, ModeOptional, nil, "PUT hello")
+	if got := conn.RemoteAddr().String(); got != "pipe" {
+		t.Fatalf("remote addr %s", got)
+	}
+	expectPayload(t, conn, "PUT hello")
+}
+
+func TestRequiredWithoutHeader(t *testing.T) {
+	conn := pipe(t, ModeRequired, nil, "GET / HTTP/1.1\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != ErrNoHeader {
+		t.Fatalf("got %v, want ErrNoHeader", err)
+	}
+}
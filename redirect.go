@@ -0,0 +1,64 @@
+package kim
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// ErrNoRedirectTarget 没有可以迁移的目标节点
+var ErrNoRedirectTarget = errors.New("no redirect target")
+
+// RedirectTargets 从naming中找到与self同名、同协议的其它节点，返回它们的DialURL，
+// 用于在节点下线之前迁移连接
+func RedirectTargets(ns naming.Naming, self naming.ServiceRegistration) ([]string, error) {
+	services, err := ns.Find(self.ServiceName())
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(services))
+	for _, service := range services {
+		if service.ServiceID() == self.ServiceID() || service.GetProtocol() != self.GetProtocol() {
+			continue
+		}
+		targets = append(targets, service.DialURL())
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoRedirectTarget
+	}
+	return targets, nil
+}
+
+// RedirectChannels 向channels中的连接推送迁移通知，targets按轮询分配给每个连接，
+// 客户端在window之内随机延迟之后重连。ids为空时通知所有的连接，返回成功通知的连接数
+func RedirectChannels(channels ChannelMap, targets []string, window time.Duration, ids ...string) (int, error) {
+	if len(targets) == 0 {
+		return 0, ErrNoRedirectTarget
+	}
+	var list []Channel
+	if len(ids) == 0 {
+		list = channels.All()
+	} else {
+		list = make([]Channel, 0, len(ids))
+		for _, id := range ids {
+			if ch, ok := channels.Get(id); ok {
+				list = append(list, ch)
+			}
+		}
+	}
+	// 每个目标只需要编码一次
+	payloads := make([][]byte, len(targets))
+	for i, target := range targets {
+		payloads[i] = pkt.Marshal(pkt.NewRedirectPkt(target, window))
+	}
+	var count int
+	for i, ch := range list {
+		if err := ch.Push(payloads[i%len(payloads)]); err != nil {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
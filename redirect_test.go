@@ -0,0 +1,91 @@
+package kim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+type testNaming struct {
+	naming.Naming
+	services []naming.ServiceRegistration
+}
+
+func (n *testNaming) Find(serviceName string) ([]naming.ServiceRegistration, error) {
+	var list []naming.ServiceRegistration
+	for _, s := range n.services {
+		if s.ServiceName() == serviceName {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
+
+// testChannel 只实现了RedirectChannels用到的方法
+type testChannel struct {
+	Channel
+	testAgent
+}
+
+func (c *testChannel) ID() string { return c.testAgent.ID() }
+
+func (c *testChannel) Push(payload []byte) error { return c.testAgent.Push(payload) }
+
+func (c *testChannel) Session() *Session { return c.testAgent.Session() }
+
+func TestRedirectTargets(t *testing.T) {
+	self := naming.NewEntry("gw1", "gateway", "ws", "10.0.0.1", 8000)
+	ns := &testNaming{services: []naming.ServiceRegistration{
+		self,
+		naming.NewEntry("gw2", "gateway", "ws", "10.0.0.2", 8000),
+		naming.NewEntry("gw3", "gateway", "tcp", "10.0.0.3", 8001),
+		naming.NewEntry("chat1", "chat", "ws", "10.0.0.4", 8000),
+	}}
+	targets, err := RedirectTargets(ns, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0] != "ws://10.0.0.2:8000" {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+
+	ns.services = ns.services[:1]
+	if _, err = RedirectTargets(ns, self); err != ErrNoRedirectTarget {
+		t.Fatalf("got %v, want ErrNoRedirectTarget", err)
+	}
+}
+
+func TestRedirectChannels(t *testing.T) {
+	channels := NewChannels(10)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		channels.Add(&testChannel{testAgent: testAgent{id: id}})
+	}
+	targets := []string{"10.0.0.2:8001", "10.0.0.3:8001"}
+	count, err := RedirectChannels(channels, targets, time.Second, "c1", "c2", "c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("redirected %d channels, want 2", count)
+	}
+	for i, id := range []string{"c1", "c2"} {
+		ch, _ := channels.Get(id)
+		pushed := ch.(*testChannel).pushed
+		if len(pushed) != 1 {
+			t.Fatalf("%s got %d frames", id, len(pushed))
+		}
+		r, ok := pkt.ReadRedirect(pushed[0])
+		if !ok || r.Address != targets[i] || r.Window != time.Second {
+			t.Fatalf("unexpected redirect %v", r)
+		}
+	}
+	if ch, _ := channels.Get("c3"); len(ch.(*testChannel).pushed) != 0 {
+		t.Fatal("c3 should not be redirected")
+	}
+
+	if _, err = RedirectChannels(channels, nil, time.Second); err != ErrNoRedirectTarget {
+		t.Fatalf("got %v, want ErrNoRedirectTarget", err)
+	}
+}
@@ -0,0 +1,85 @@
+package kim
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+// ErrCommandNotFound 指令没有注册处理函数
+var ErrCommandNotFound = errors.New("command not found")
+
+// Router 按指令分发逻辑消息包，它实现了MessageListener接口，
+// 可以直接通过 Server.SetMessageListener 使用
+type Router struct {
+	sync.RWMutex
+	middlewares HandlersChain
+	handlers    map[string]HandlersChain
+}
+
+// NewRouter NewRouter
+func NewRouter() *Router {
+	return &Router{
+		middlewares: make(HandlersChain, 0),
+		handlers:    make(map[string]HandlersChain),
+	}
+}
+
+// Use 添加全局中间件，只对之后注册的指令生效
+func (r *Router) Use(middlewares ...HandlerFunc) {
+	r.Lock()
+	defer r.Unlock()
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Handle 注册指令的处理函数，如 login.signin、chat.user.talk
+func (r *Router) Handle(command string, handlers ...HandlerFunc) {
+	r.Lock()
+	defer r.Unlock()
+	chain := make(HandlersChain, 0, len(r.middlewares)+len(handlers))
+	chain = append(chain, r.middlewares...)
+	chain = append(chain, handlers...)
+	r.handlers[command] = chain
+}
+
+// Receive 实现MessageListener，解码消息包并分发
+func (r *Router) Receive(ag Agent, payload []byte) {
+	packet, err := pkt.MustReadLogicPkt(bytes.NewReader(payload))
+	if err != nil {
+		logger.WithFields(logger.Fields{
+			"module": "router",
+			"id":     ag.ID(),
+		}).Warn(err)
+		return
+	}
+	// 以通道ID为准，防止客户端伪造
+	packet.ChannelId = ag.ID()
+	if err := r.Serve(packet, ag); err != nil {
+		logger.WithFields(logger.Fields{
+			"module":  "router",
+			"id":      ag.ID(),
+			"command": packet.Command,
+		}).Warn(err)
+	}
+}
+
+// Serve 执行指令对应的处理链，未注册的指令返回 NotImplemented
+func (r *Router) Serve(packet *pkt.LogicPkt, ag Agent) error {
+	if ag == nil {
+		return errors.New("agent is nil")
+	}
+	r.RLock()
+	chain, ok := r.handlers[packet.Command]
+	r.RUnlock()
+
+	ctx := newContext(packet, ag, chain)
+	if !ok {
+		_ = ctx.RespWithError(pkt.Status_NotImplemented, ErrCommandNotFound)
+		return ErrCommandNotFound
+	}
+	ctx.Next()
+	return nil
+}
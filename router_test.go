@@ -0,0 +1,92 @@
+package kim
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sunrnalike/sun/wire/pkt"
+)
+
+type testAgent struct {
+	id     string
+	pushed [][]byte
+}
+
+func (a *testAgent) ID() string { return a.id }
+
+func (a *testAgent) Session() *Session { return &Session{ChannelID: a.id} }
+
+func (a *testAgent) Push(payload []byte) error {
+	a.pushed = append(a.pushed, payload)
+	return nil
+}
+
+func (a *testAgent) last(t *testing.T) *pkt.LogicPkt {
+	if len(a.pushed) == 0 {
+		t.Fatal("nothing pushed")
+	}
+	p, err := pkt.MustReadLogicPkt(bytes.NewReader(a.pushed[len(a.pushed)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRouterDispatch(t *testing.T) {
+	var trace []string
+	r := NewRouter()
+	r.Use(func(ctx Context) {
+		trace = append(trace, "before")
+		ctx.Next()
+		trace = append(trace, "after")
+	})
+	r.Handle("chat.user.talk", func(ctx Context) {
+		trace = append(trace, ctx.Header().ChannelId)
+		_ = ctx.Resp(pkt.Status_Success, nil)
+	})
+
+	ag := &testAgent{id: "ch1"}
+	r.Receive(ag, pkt.Marshal(pkt.New("chat.user.talk", pkt.WithChannel("fake"))))
+
+	if len(trace) != 3 || trace[0] != "before" || trace[1] != "ch1" || trace[2] != "after" {
+		t.Fatalf("unexpected trace %v", trace)
+	}
+	resp := ag.last(t)
+	if resp.Command != "chat.user.talk" || resp.Flag != pkt.Flag_Response || resp.Status != pkt.Status_Success {
+		t.Fatalf("unexpected response %v", &resp.Header)
+	}
+}
+
+func TestRouterAbort(t *testing.T) {
+	called := false
+	r := NewRouter()
+	r.Use(func(ctx Context) {
+		ctx.Abort()
+		_ = ctx.RespWithError(pkt.Status_Unauthorized, errors.New("denied"))
+	})
+	r.Handle("login.signout", func(ctx Context) {
+		called = true
+	})
+
+	ag := &testAgent{id: "ch1"}
+	r.Receive(ag, pkt.Marshal(pkt.New("login.signout")))
+	if called {
+		t.Fatal("handler should not be called after abort")
+	}
+	if resp := ag.last(t); resp.Status != pkt.Status_Unauthorized || resp.StringBody() != "denied" {
+		t.Fatalf("unexpected response %v", &resp.Header)
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	r := NewRouter()
+	ag := &testAgent{id: "ch1"}
+	err := r.Serve(pkt.New("unknown.cmd"), ag)
+	if err != ErrCommandNotFound {
+		t.Fatalf("expect ErrCommandNotFound, got %v", err)
+	}
+	if resp := ag.last(t); resp.Status != pkt.Status_NotImplemented {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+}
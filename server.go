@@ -2,10 +2,13 @@ package kim
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"time"
 
 	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 const (
@@ -15,6 +18,21 @@ const (
 	DefaultHeartbeat = time.Second * 55
 )
 
+// DefaultMaxFrameSize 单个帧payload的默认最大长度
+const DefaultMaxFrameSize = 1024 * 1024
+
+// DefaultWriteBufferSize 连接写缓冲区的默认大小
+const DefaultWriteBufferSize = 4 * 1024
+
+// CloseReasonShutdown 服务下线时OpClose帧中的原因
+const CloseReasonShutdown = "server shutdown"
+
+// ErrFrameTooLarge 帧的长度超过了限制，读取方应该关闭连接
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrLoginTimeout 在登录超时之前没有完成握手，Error()作为OpClose帧中的原因
+var ErrLoginTimeout = errors.New("login timeout")
+
 // Server 定义了一个tcp/websocket不同协议通用的服务端的接口
 type Server interface {
 	naming.ServiceRegistration
@@ -36,39 +54,84 @@ type Server interface {
 	// 	string channelID
 	// 	[]byte 序列化之后的消息数据
 	Push(string, []byte) error
+	// Redirect 通知连接迁移到targets中的节点，客户端在window之内随机延迟之后重连，
+	// ids为空时通知所有连接，返回成功通知的连接数。targets通常来自RedirectTargets
+	Redirect(targets []string, window time.Duration, ids ...string) (int, error)
+	// PushToUser 推送消息到用户所有满足filters的在线设备，返回成功推送的设备数
+	PushToUser(userID string, payload []byte, filters ...DeviceFilter) (int, error)
+	// Kick 踢掉用户所有满足filters的在线设备，如 Kick(uid, "", DeviceIDs(deviceID))
+	Kick(userID string, reason string, filters ...DeviceFilter) int
+	// Broadcast 推送消息到所有满足filters的连接，返回每个目标的推送结果。
+	// 消息按每种协议只编码一次，不会等待发送队列已满的连接
+	Broadcast(payload []byte, filters ...DeviceFilter) *PushReport
+	// PushMany 推送消息到ids中满足filters的连接，返回每个目标的推送结果
+	PushMany(ids []string, payload []byte, filters ...DeviceFilter) *PushReport
 	// Shutdown 服务下线，关闭连接
 	Shutdown(context.Context) error
 }
 
 // Acceptor 连接接收器
 type Acceptor interface {
-	// Accept 返回一个握手完成的Channel对象或者一个error。
-	// 业务层需要处理不同协议和网络环境的下连接握手协议
-	Accept(Conn, time.Duration) (string, error)
+	// Accept 返回握手完成之后的会话信息或者一个error，Session.ChannelID不能为空。
+	// 业务层需要处理不同协议和网络环境的下连接握手协议。
+	// 写入的握手响应在Accept返回之后才会被Flush，需要等待客户端回复时要自己调用Flush
+	Accept(Conn, time.Duration) (*Session, error)
+}
+
+// AcceptWithin 在conn上设置读超时之后调用acceptor.Accept，超时返回ErrLoginTimeout，
+// Accept返回之后把它写入的握手响应Flush出去，握手成功之后清除读超时，
+// 并在Session.RemoteIP为空时填入连接的来源IP
+func AcceptWithin(acceptor Acceptor, conn Conn, loginwait time.Duration) (*Session, error) {
+	deadline := time.Now().Add(loginwait)
+	_ = conn.SetReadDeadline(deadline)
+	session, err := acceptor.Accept(conn, loginwait)
+	_ = conn.Flush()
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() || !time.Now().Before(deadline) {
+			return nil, ErrLoginTimeout
+		}
+		return nil, err
+	}
+	if session == nil || session.ChannelID == "" {
+		return nil, errors.New("channelId is required")
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if session.RemoteIP == "" && conn.RemoteAddr() != nil {
+		session.RemoteIP = conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(session.RemoteIP); err == nil {
+			session.RemoteIP = host
+		}
+	}
+	return session, nil
 }
 
 // MessageListener 监听消息
 type MessageListener interface {
-	// 收到消息回调
+	// 收到消息回调，payload 通常是一个序列化后的 pkt.LogicPkt，
+	// 可以通过 pkt.MustReadLogicPkt 解码
 	Receive(Agent, []byte)
 }
 
 // StateListener 状态监听器
 type StateListener interface {
-	// 连接断开回调
-	Disconnect(string) error
+	// 连接断开回调，Session就是握手时Acceptor返回的会话信息
+	Disconnect(*Session) error
 }
 
 // Agent is interface of client side
 type Agent interface {
 	ID() string
 	Push([]byte) error
+	// Session 握手时Acceptor返回的会话信息
+	Session() *Session
 }
 
 // Conn Connection
 type Conn interface {
 	net.Conn
 	ReadFrame() (Frame, error)
+	// WriteFrame 写入的数据可能被缓存，需要调用Flush才会真正发送
 	WriteFrame(OpCode, []byte) error
 	Flush() error
 }
@@ -79,6 +142,13 @@ type Channel interface {
 	Agent
 	// Close 关闭连接
 	Close() error
+	// SetSession 设置会话信息，需要在加入ChannelMap之前调用
+	SetSession(*Session)
+	// Shutdown 不再接收新的消息，把已经Push的消息写完之后，
+	// 发送一个带有reason的OpClose帧并关闭连接，ctx到期时放弃剩余的消息
+	Shutdown(ctx context.Context, reason string) error
+	// TryPush 异步写一个预先编码的帧，发送队列已满时返回ErrWriteQueueFull而不是等待
+	TryPush(*PreparedFrame) error
 	Readloop(lst MessageListener) error
 	// SetWriteWait 设置写超时
 	SetWriteWait(time.Duration)
@@ -94,7 +164,11 @@ type Client interface {
 	// SetDialer 设置拨号处理器
 	SetDialer(Dialer)
 	Send([]byte) error
+	// SendPkt 序列化并发送一个消息包
+	SendPkt(pkt.Packet) error
 	Read() (Frame, error)
+	// ReadPkt 读取一个消息包，返回 *pkt.LogicPkt 或 *pkt.BasicPkt
+	ReadPkt() (interface{}, error)
 	// Close 关闭
 	Close()
 }
@@ -109,6 +183,8 @@ type DialerContext struct {
 	Name    string
 	Address string
 	Timeout time.Duration
+	// TLSConfig 不为nil时Dialer需要建立TLS连接
+	TLSConfig *tls.Config
 }
 
 // OpCode OpCode
@@ -0,0 +1,48 @@
+package kim
+
+import "sync"
+
+// Session 握手时由Acceptor返回的会话信息，保存在Channel中，
+// MessageListener通过Agent.Session()获取，StateListener.Disconnect时传回
+type Session struct {
+	ChannelID string // 必填，ChannelMap中的索引
+	UserID    string
+	DeviceID  string
+	// DeviceType 设备类型，如ios、android、web，用于PushToUser等按设备类型过滤
+	DeviceType string
+	App        string
+	Version    string // 客户端版本
+	RemoteIP   string // 为空时由服务端填入连接的来源IP
+
+	mu    sync.RWMutex
+	attrs map[string]string
+}
+
+// Get 读取一个自定义属性
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.attrs[key]
+	return val, ok
+}
+
+// Set 设置一个自定义属性，可以在连接的整个生命周期中并发调用
+func (s *Session) Set(key, val string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = val
+}
+
+// Attrs 返回所有自定义属性的拷贝
+func (s *Session) Attrs() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attrs := make(map[string]string, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
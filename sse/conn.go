@@ -0,0 +1,265 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+)
+
+// errors
+var (
+	ErrSessionClosed = errors.New("sse: session closed")
+	errNotSupported  = errors.New("sse: raw read/write is not supported, use ReadFrame/WriteFrame")
+)
+
+// Frame Frame
+type Frame struct {
+	OpCode  sun.OpCode
+	Payload []byte
+}
+
+// SetOpCode SetOpCode
+func (f *Frame) SetOpCode(code sun.OpCode) {
+	f.OpCode = code
+}
+
+// GetOpCode GetOpCode
+func (f *Frame) GetOpCode() sun.OpCode {
+	return f.OpCode
+}
+
+// SetPayload SetPayload
+func (f *Frame) SetPayload(payload []byte) {
+	f.Payload = payload
+}
+
+// GetPayload GetPayload
+func (f *Frame) GetPayload() []byte {
+	return f.Payload
+}
+
+// Conn 一个text/event-stream响应，实现了sun.Conn，因此可以直接交给sun.NewChannel。
+// 下行的帧写成SSE事件，上行的消息由POST请求投递，ReadFrame读取
+type Conn struct {
+	sid     string
+	req     *http.Request
+	w       http.ResponseWriter
+	flusher http.Flusher
+	base64  bool
+	uplink  chan sun.Frame
+	closed  *sun.Event
+
+	mu          sync.Mutex // 串行化对ResponseWriter的写入，见wait
+	dmu         sync.Mutex
+	deadline    time.Time // ReadFrame的超时，握手阶段由AcceptWithin设置
+	established bool      // 握手完成之后忽略读超时
+}
+
+// timeoutError 实现net.Error，AcceptWithin据此返回ErrLoginTimeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "sse: read timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newConn(sid string, w http.ResponseWriter, r *http.Request, base64 bool) (*Conn, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	return &Conn{
+		sid:     sid,
+		req:     r,
+		w:       w,
+		flusher: flusher,
+		base64:  base64,
+		uplink:  make(chan sun.Frame, 16),
+		closed:  sun.NewEvent(),
+	}, true
+}
+
+// Request 返回建立事件流的http请求，Acceptor可以从中读取token、cookie等鉴权信息
+func Request(conn sun.Conn) (*http.Request, bool) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return nil, false
+	}
+	return c.req, true
+}
+
+// SessionID 会话ID，客户端发送上行消息时通过HeaderSessionID携带
+func (c *Conn) SessionID() string {
+	return c.sid
+}
+
+// ReadFrame 读取一个上行的消息，会话关闭或者客户端断开时返回io.EOF。
+// 只有握手阶段的读超时才会生效，握手之后事件流本身就是存活的证明，
+// 只接收推送、从不上行的客户端不会因为Readloop的readwait被断开
+func (c *Conn) ReadFrame() (sun.Frame, error) {
+	var timeout <-chan time.Time
+	c.dmu.Lock()
+	deadline := c.deadline
+	c.dmu.Unlock()
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case frame := <-c.uplink:
+		return frame, nil
+	case <-c.closed.Done():
+		return nil, io.EOF
+	case <-c.req.Context().Done():
+		return nil, io.EOF
+	case <-timeout:
+		return nil, timeoutError{}
+	}
+}
+
+// WriteFrame 把帧写成一个SSE事件：
+// OpBinary/OpText为默认的message事件，OpClose为close事件，其它控制帧写成注释用于保活
+func (c *Conn) WriteFrame(code sun.OpCode, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed.HasFired() {
+		return ErrSessionClosed
+	}
+	switch code {
+	case sun.OpBinary, sun.OpText:
+		if c.base64 {
+			payload = []byte(base64.StdEncoding.EncodeToString(payload))
+		}
+		return c.writeEvent("", payload)
+	case sun.OpClose:
+		return c.writeEvent("close", payload)
+	default:
+		_, err := io.WriteString(c.w, ": keepalive\n\n")
+		return err
+	}
+}
+
+// writeEvent 多行的payload拆成多个data字段，浏览器会用\n重新拼接
+func (c *Conn) writeEvent(event string, payload []byte) error {
+	bw := bufio.NewWriter(c.w)
+	if event != "" {
+		_, _ = bw.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		_, _ = bw.WriteString("data: ")
+		_, _ = bw.Write(line)
+		_ = bw.WriteByte('\n')
+	}
+	_ = bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// writeOpen 第一个事件下发会话ID
+func (c *Conn) writeOpen() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeEvent("open", []byte(c.sid)); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Flush 把事件立即发送给客户端
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed.HasFired() {
+		return ErrSessionClosed
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// deliver 投递一个上行的消息，队列满时阻塞，从而对客户端形成背压
+func (c *Conn) deliver(done <-chan struct{}, frame sun.Frame) error {
+	select {
+	case c.uplink <- frame:
+		return nil
+	case <-c.closed.Done():
+		return ErrSessionClosed
+	case <-done:
+		return ErrSessionClosed
+	}
+}
+
+// Close 关闭会话，不等待正在进行的写入，因此一个卡住的客户端不会阻塞Close。
+// 服务端的handler随后通过wait等待写入结束再返回
+func (c *Conn) Close() error {
+	c.closed.Fire()
+	return nil
+}
+
+// wait 等待正在进行的写入结束，需要在Close之后调用，返回之后不会再写入ResponseWriter
+func (c *Conn) wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+}
+
+// Read 不支持
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// Write 不支持
+func (c *Conn) Write(b []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+// LocalAddr LocalAddr
+func (c *Conn) LocalAddr() net.Addr {
+	return addr(c.req.Host)
+}
+
+// RemoteAddr 建立事件流的http请求的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return addr(c.req.RemoteAddr)
+}
+
+// SetDeadline 只设置读超时，见SetWriteDeadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline ReadFrame的超时，零值表示不超时，握手完成之后被忽略
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	if !c.established {
+		c.deadline = t
+	}
+	c.dmu.Unlock()
+	return nil
+}
+
+// establish 握手完成，清除并不再接受读超时
+func (c *Conn) establish() {
+	c.dmu.Lock()
+	c.established = true
+	c.deadline = time.Time{}
+	c.dmu.Unlock()
+}
+
+// SetWriteDeadline http.ResponseWriter不支持写超时，卡住的写入在客户端断开时返回
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// addr 实现net.Addr
+type addr string
+
+func (a addr) Network() string { return "http" }
+
+func (a addr) String() string { return string(a) }
@@ -0,0 +1,367 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/naming"
+)
+
+// HeaderSessionID 客户端发送上行消息时携带的会话ID，
+// 会话ID在事件流的第一个open事件中下发
+const HeaderSessionID = "X-Session-Id"
+
+// DefaultKeepAlive 发送保活注释的间隔，需要小于代理的空闲超时
+const DefaultKeepAlive = time.Second * 25
+
+// ServerOptions ServerOptions
+type ServerOptions struct {
+	loginwait    time.Duration //登陆超时
+	writewait    time.Duration //写超时
+	keepalive    time.Duration //保活注释的间隔
+	maxFrameSize int           //上行消息的最大长度
+	base64       bool          //下行的payload使用base64编码
+	path         string        //事件流与上行消息的路径
+}
+
+// ServerOption ServerOption
+type ServerOption func(*ServerOptions)
+
+// WithPath 设置事件流与上行消息的路径，默认为 /
+func WithPath(path string) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.path = path
+	}
+}
+
+// WithKeepAlive 设置保活注释的间隔
+func WithKeepAlive(interval time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.keepalive = interval
+	}
+}
+
+// WithMaxFrameSize 设置上行消息的最大长度，超过时返回413
+func WithMaxFrameSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxFrameSize = size
+	}
+}
+
+// WithBase64 下行的payload使用base64编码，推送二进制数据(如pkt.LogicPkt)时需要开启，
+// 默认按文本原样写入data字段
+func WithBase64() ServerOption {
+	return func(opts *ServerOptions) {
+		opts.base64 = true
+	}
+}
+
+// Server 是Server-Sent Events的Server实现，用于只需要下行推送的场景，如数据看板。
+//
+//   - GET  建立事件流，第一个事件为 event: open，data为会话ID。open在握手之前发送，
+//     Acceptor可以通过Request获取请求中的鉴权信息，也可以通过ReadFrame读取客户端POST的鉴权消息；
+//     握手失败时发送一个 event: close，data为原因
+//   - POST 带HeaderSessionID：body作为一条上行消息交给MessageListener
+//
+// Push的消息写成 data: 事件，连接断开时通过StateListener通知
+type Server struct {
+	listen string
+	naming.ServiceRegistration
+	sun.ChannelMap
+	sun.Acceptor
+	sun.MessageListener
+	sun.StateListener
+	once     sync.Once
+	options  ServerOptions
+	httpsrv  *http.Server
+	sessions sync.Map // sid -> *Conn
+	quit     *sun.Event
+}
+
+// NewServer NewServer
+func NewServer(listen string, service naming.ServiceRegistration, options ...ServerOption) sun.Server {
+	opts := ServerOptions{
+		loginwait:    sun.DefaultLoginWait,
+		writewait:    sun.DefaultWriteWait,
+		keepalive:    DefaultKeepAlive,
+		maxFrameSize: sun.DefaultMaxFrameSize,
+		path:         "/",
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	s := &Server{
+		listen:              listen,
+		ServiceRegistration: service,
+		options:             opts,
+		quit:                sun.NewEvent(),
+		httpsrv: &http.Server{
+			Addr:              listen,
+			ReadHeaderTimeout: sun.DefaultLoginWait,
+		},
+	}
+	// http.Server.Shutdown会等待事件流的handler返回，先关闭会话
+	s.httpsrv.RegisterOnShutdown(s.closeSessions)
+	return s
+}
+
+// Start server
+func (s *Server) Start() error {
+	log := logger.WithFields(logger.Fields{
+		"module": "sse.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	})
+
+	if s.Acceptor == nil {
+		s.Acceptor = new(defaultAcceptor)
+	}
+	if s.StateListener == nil {
+		return fmt.Errorf("StateListener is nil")
+	}
+	if s.ChannelMap == nil {
+		s.ChannelMap = sun.NewChannels(100)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.options.path, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.stream(w, r)
+		case http.MethodPost:
+			s.uplink(w, r)
+		default:
+			resp(w, http.StatusMethodNotAllowed, "")
+		}
+	})
+	s.httpsrv.Handler = mux
+
+	log.Infoln("started")
+	err := s.httpsrv.ListenAndServe()
+	// 调用Shutdown之后正常退出
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// stream 完成握手之后一直持有这个响应，直到客户端断开或者会话被关闭
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	log := logger.WithFields(logger.Fields{
+		"module": "sse.server",
+		"id":     s.ServiceID(),
+	})
+	// step 1
+	conn, ok := newConn(ksuid.New().String(), w, r, s.options.base64)
+	if !ok {
+		resp(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	// 返回之前等待正在进行的写入结束
+	defer func() {
+		conn.Close()
+		conn.wait()
+	}()
+
+	// step 2 响应头与open事件，握手阶段客户端就可以携带会话ID上行鉴权消息
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := conn.writeOpen(); err != nil {
+		return
+	}
+	s.sessions.Store(conn.SessionID(), conn)
+	defer s.sessions.Delete(conn.SessionID())
+	// Shutdown之后不再接受新的会话，Store之前已经执行过的closeSessions不会关闭它
+	if s.quit.HasFired() {
+		_ = conn.WriteFrame(sun.OpClose, []byte(sun.CloseReasonShutdown))
+		_ = conn.Flush()
+		return
+	}
+
+	// step 3
+	session, err := sun.AcceptWithin(s.Acceptor, conn, s.options.loginwait)
+	if err != nil {
+		log.Info(err)
+		_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+		_ = conn.Flush()
+		return
+	}
+	conn.establish()
+
+	// step 4
+	channel := sun.NewChannel(session.ChannelID, conn)
+	channel.SetSession(session)
+	channel.SetWriteWait(s.options.writewait)
+	if _, err = sun.AddWithPolicy(s.ChannelMap, channel, sun.DuplicateReject, nil); err != nil {
+		log.Warnf("channel %s rejected - %v", channel.ID(), err)
+		_ = channel.WriteFrame(sun.OpClose, []byte(err.Error()))
+		channel.Close()
+		return
+	}
+
+	go func() {
+		tick := time.NewTicker(s.options.keepalive)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := channel.WriteFrame(sun.OpPing, nil); err != nil {
+					conn.Close()
+					return
+				}
+			case <-conn.closed.Done():
+				return
+			}
+		}
+	}()
+
+	// step 5 客户端断开或者会话关闭时返回
+	err = channel.Readloop(s.MessageListener)
+	if err != nil {
+		log.Info(err)
+	}
+	// step 6
+	if s.CompareAndRemove(channel) {
+		err = s.Disconnect(channel.Session())
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+	channel.Close()
+}
+
+// uplink body作为一条上行消息投递给会话
+func (s *Server) uplink(w http.ResponseWriter, r *http.Request) {
+	val, ok := s.sessions.Load(r.Header.Get(HeaderSessionID))
+	if !ok {
+		resp(w, http.StatusNotFound, "session not found")
+		return
+	}
+	conn := val.(*Conn)
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.options.maxFrameSize)))
+	if err != nil {
+		resp(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	err = conn.deliver(r.Context().Done(), &Frame{OpCode: sun.OpBinary, Payload: payload})
+	if err != nil {
+		resp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) closeSessions() {
+	s.sessions.Range(func(key, val interface{}) bool {
+		val.(*Conn).Close()
+		return true
+	})
+}
+
+// Shutdown 通知所有事件流服务下线，在ctx到期之前写完队列中的消息与close事件，
+// 返回时每个会话都已经回调了StateListener.Disconnect
+func (s *Server) Shutdown(ctx context.Context) error {
+	log := logger.WithFields(logger.Fields{
+		"module": "sse.server",
+		"id":     s.ServiceID(),
+	})
+	var err error
+	s.once.Do(func() {
+		defer func() {
+			log.Infoln("shutdown")
+		}()
+		s.quit.Fire()
+		// 先把队列中的消息与close事件写给客户端，Readloop随后退出并回调Disconnect
+		if s.ChannelMap != nil {
+			sun.ShutdownChannels(ctx, s.ChannelMap, sun.CloseReasonShutdown)
+		}
+		// 停止监听，关闭还在握手中的事件流，并等待所有的handler返回
+		err = s.httpsrv.Shutdown(ctx)
+	})
+	return err
+}
+
+// Push string channelID
+// []byte data
+func (s *Server) Push(id string, data []byte) error {
+	ch, ok := s.ChannelMap.Get(id)
+	if !ok {
+		return sun.ErrChannelNotFound
+	}
+	return ch.Push(data)
+}
+
+// Redirect 通知连接迁移到其它节点
+func (s *Server) Redirect(targets []string, window time.Duration, ids ...string) (int, error) {
+	return sun.RedirectChannels(s.ChannelMap, targets, window, ids...)
+}
+
+// PushToUser 推送消息到用户所有满足filters的在线设备
+func (s *Server) PushToUser(userID string, payload []byte, filters ...sun.DeviceFilter) (int, error) {
+	return sun.PushToUser(s.ChannelMap, userID, payload, filters...)
+}
+
+// Kick 踢掉用户所有满足filters的在线设备
+func (s *Server) Kick(userID string, reason string, filters ...sun.DeviceFilter) int {
+	return sun.KickUser(s.ChannelMap, userID, reason, filters...)
+}
+
+// Broadcast 推送消息到所有满足filters的连接
+func (s *Server) Broadcast(payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.BroadcastChannels(s.ChannelMap, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// PushMany 推送消息到ids中满足filters的连接
+func (s *Server) PushMany(ids []string, payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.PushChannels(s.ChannelMap, ids, payload, sun.DefaultPushConcurrency, filters...)
+}
+
+// SetAcceptor SetAcceptor
+func (s *Server) SetAcceptor(acceptor sun.Acceptor) {
+	s.Acceptor = acceptor
+}
+
+// SetMessageListener SetMessageListener
+func (s *Server) SetMessageListener(listener sun.MessageListener) {
+	s.MessageListener = listener
+}
+
+// SetStateListener SetStateListener
+func (s *Server) SetStateListener(listener sun.StateListener) {
+	s.StateListener = listener
+}
+
+// SetChannelMap SetChannelMap
+func (s *Server) SetChannelMap(channels sun.ChannelMap) {
+	s.ChannelMap = channels
+}
+
+// SetReadWait 事件流不使用读超时，客户端断开时会话立即结束
+func (s *Server) SetReadWait(readwait time.Duration) {
+}
+
+func resp(w http.ResponseWriter, code int, body string) {
+	w.WriteHeader(code)
+	if body != "" {
+		_, _ = w.Write([]byte(body))
+	}
+	logger.Warnf("response with code:%d %s", code, body)
+}
+
+type defaultAcceptor struct {
+}
+
+// Accept defaultAcceptor
+func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: ksuid.New().String()}, nil
+}
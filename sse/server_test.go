@@ -0,0 +1,317 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+)
+
+type queryAcceptor struct{}
+
+// Accept 使用请求参数中的token作为channelId
+func (a *queryAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	req, ok := Request(conn)
+	if !ok {
+		return nil, errors.New("not a sse conn")
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return nil, errors.New("token is required")
+	}
+	return &sun.Session{ChannelID: token}, nil
+}
+
+type echoListener struct {
+	disconnected chan string
+}
+
+func (l *echoListener) Receive(ag sun.Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func (l *echoListener) Disconnect(session *sun.Session) error {
+	l.disconnected <- session.ChannelID
+	return nil
+}
+
+type event struct {
+	name string
+	data string
+}
+
+// readEvent 读取一个事件，跳过注释
+func readEvent(r *bufio.Reader) (event, error) {
+	var ev event
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data == nil {
+				continue
+			}
+			ev.data = strings.Join(data, "\n")
+			return ev, nil
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lst.Addr().String()
+	lst.Close()
+
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithPath("/events"))
+	listener := &echoListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(new(queryAcceptor))
+	srv.SetMessageListener(listener)
+	srv.SetStateListener(listener)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+	url := "http://" + addr + "/events"
+
+	// 握手失败时在open之后发送close事件
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := bufio.NewReader(resp.Body)
+	if ev, err := readEvent(rejected); err != nil || ev.name != "open" {
+		t.Fatal(ev, err)
+	}
+	if ev, err := readEvent(rejected); err != nil || ev.name != "close" || ev.data != "token is required" {
+		t.Fatal(ev, err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"?token=u1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	open, err := readEvent(r)
+	if err != nil || open.name != "open" {
+		t.Fatal(open, err)
+	}
+
+	// 上行消息由MessageListener回显
+	post, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("hello\nworld"))
+	post.Header.Set(HeaderSessionID, open.data)
+	presp, err := http.DefaultClient.Do(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presp.Body.Close()
+	if presp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %d, want 204", presp.StatusCode)
+	}
+	ev, err := readEvent(r)
+	if err != nil || ev.data != "hello\nworld" {
+		t.Fatal(ev, err)
+	}
+
+	if err = srv.Push("u1", []byte("push")); err != nil {
+		t.Fatal(err)
+	}
+	ev, err = readEvent(r)
+	if err != nil || ev.data != "push" {
+		t.Fatal(ev, err)
+	}
+
+	// 客户端断开之后回调Disconnect
+	cancel()
+	select {
+	case id := <-listener.disconnected:
+		if id != "u1" {
+			t.Fatalf("disconnect %s, want u1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+}
+
+type frameAcceptor struct{}
+
+// Accept 读取客户端POST的第一个消息作为channelId
+func (a *frameAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return &sun.Session{ChannelID: string(frame.GetPayload())}, nil
+}
+
+func TestFrameLogin(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lst.Addr().String()
+	lst.Close()
+
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"})
+	srv.(*Server).options.loginwait = time.Millisecond * 200
+	listener := &echoListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(new(frameAcceptor))
+	srv.SetMessageListener(listener)
+	srv.SetStateListener(listener)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+	url := "http://" + addr + "/"
+
+	connect := func() (*bufio.Reader, string, func()) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(resp.Body)
+		open, err := readEvent(r)
+		if err != nil || open.name != "open" {
+			t.Fatal(open, err)
+		}
+		return r, open.data, func() { resp.Body.Close() }
+	}
+
+	// 使用open中的会话ID上行鉴权消息
+	r, sid, done := connect()
+	defer done()
+	post, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("u1"))
+	post.Header.Set(HeaderSessionID, sid)
+	presp, err := http.DefaultClient.Do(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presp.Body.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := srv.(*Server).Get("u1"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err = srv.Push("u1", []byte("welcome")); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := readEvent(r); err != nil || ev.data != "welcome" {
+		t.Fatal(ev, err)
+	}
+
+	// 没有上行鉴权消息时在loginwait之后关闭
+	r, _, done2 := connect()
+	defer done2()
+	if ev, err := readEvent(r); err != nil || ev.name != "close" || ev.data != sun.ErrLoginTimeout.Error() {
+		t.Fatal(ev, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lst.Addr().String()
+	lst.Close()
+
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"})
+	listener := &echoListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(new(queryAcceptor))
+	srv.SetMessageListener(listener)
+	srv.SetStateListener(listener)
+	go func() {
+		_ = srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	resp, err := http.Get("http://" + addr + "/?token=u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if ev, err := readEvent(r); err != nil || ev.name != "open" {
+		t.Fatal(ev, err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = srv.Push("u1", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown返回时已经回调了Disconnect
+	select {
+	case id := <-listener.disconnected:
+		if id != "u1" {
+			t.Fatalf("disconnect %s, want u1", id)
+		}
+	default:
+		t.Fatal("Disconnect is not called")
+	}
+	for i := 0; i < 10; i++ {
+		if ev, err := readEvent(r); err != nil || ev.data != "hello" {
+			t.Fatal(ev, err)
+		}
+	}
+	if ev, err := readEvent(r); err != nil || ev.name != "close" || ev.data != sun.CloseReasonShutdown {
+		t.Fatal(ev, err)
+	}
+}
+
+func TestIdleStream(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	conn, _ := newConn("s1", httptest.NewRecorder(), req, false)
+	conn.establish()
+
+	channel := sun.NewChannel("u1", conn)
+	channel.SetReadWait(time.Millisecond * 50)
+	done := make(chan error, 1)
+	go func() {
+		done <- channel.Readloop(&echoListener{})
+	}()
+	// 只接收推送的事件流不受readwait影响
+	select {
+	case err := <-done:
+		t.Fatalf("idle stream closed by readwait: %v", err)
+	case <-time.After(time.Millisecond * 300):
+	}
+	conn.Close()
+	if err := <-done; err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package tcp
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	sun "github.com/sunrnalike/sun"
 	"net/url"
 	"sync"
@@ -10,13 +13,25 @@ import (
 	"time"
 
 	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 // ClientOptions ClientOptions
 type ClientOptions struct {
-	Heartbeat time.Duration //登陆超时
-	ReadWait  time.Duration //读超时
-	WriteWait time.Duration //写超时
+	Heartbeat    time.Duration //登陆超时
+	ReadWait     time.Duration //读超时
+	WriteWait    time.Duration //写超时
+	MaxFrameSize int           //单个帧payload的最大长度
+	// Compress 服务端在帧头中声明支持之后压缩上行消息，
+	// Dialer需要在握手帧中使用WriteFrameWithFlags声明FlagCompressAccept
+	Compress          bool
+	CompressLevel     int //压缩级别
+	CompressThreshold int //超过该长度的消息才会被压缩
+	// TLSConfig 通过DialerContext传给Dialer，不为nil时使用TLS连接，
+	// 需要mTLS时在Certificates中设置客户端证书
+	TLSConfig *tls.Config
+	// RedirectWindow 迁移通知中没有指定时间窗口时，在这个时间窗口之内随机延迟之后重连
+	RedirectWindow time.Duration
 }
 
 // Client is a websocket implement of the terminal
@@ -29,6 +44,9 @@ type Client struct {
 	conn    sun.Conn
 	state   int32
 	options ClientOptions
+	// 收到迁移通知之后，在redirectAt重连到target
+	target     string
+	redirectAt time.Time
 }
 
 // NewClient NewClient
@@ -39,6 +57,9 @@ func NewClient(id, name string, opts ClientOptions) sun.Client {
 	if opts.ReadWait == 0 {
 		opts.ReadWait = sun.DefaultReadWait
 	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = sun.DefaultMaxFrameSize
+	}
 	cli := &Client{
 		id:      id,
 		name:    name,
@@ -68,20 +89,12 @@ func (c *Client) Connect(addr string) error {
 		return fmt.Errorf("client has connected")
 	}
 
-	rawconn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
-		Id:      c.id,
-		Name:    c.name,
-		Address: addr,
-		Timeout: sun.DefaultLoginWait,
-	})
+	conn, err := c.dial(addr)
 	if err != nil {
 		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 		return err
 	}
-	if rawconn == nil {
-		return fmt.Errorf("conn is nil")
-	}
-	c.conn = NewConn(rawconn)
+	c.conn = conn
 
 	if c.options.Heartbeat > 0 {
 		go func() {
@@ -94,6 +107,28 @@ func (c *Client) Connect(addr string) error {
 	return nil
 }
 
+func (c *Client) dial(addr string) (sun.Conn, error) {
+	rawconn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
+		Id:        c.id,
+		Name:      c.name,
+		Address:   addr,
+		Timeout:   sun.DefaultLoginWait,
+		TLSConfig: c.options.TLSConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rawconn == nil {
+		return nil, fmt.Errorf("conn is nil")
+	}
+	return NewConnWithOptions(rawconn, ConnOptions{
+		MaxFrameSize:      c.options.MaxFrameSize,
+		Compress:          c.options.Compress,
+		CompressLevel:     c.options.CompressLevel,
+		CompressThreshold: c.options.CompressThreshold,
+	}), nil
+}
+
 // SetDialer 设置握手逻辑
 func (c *Client) SetDialer(dialer sun.Dialer) {
 	c.Dialer = dialer
@@ -110,38 +145,136 @@ func (c *Client) Send(payload []byte) error {
 	if err != nil {
 		return err
 	}
-	return c.conn.WriteFrame(sun.OpBinary, payload)
+	if err = c.conn.WriteFrame(sun.OpBinary, payload); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
+// SendPkt 序列化消息包并发送
+func (c *Client) SendPkt(p pkt.Packet) error {
+	return c.Send(pkt.Marshal(p))
 }
 
 // Close 关闭
 func (c *Client) Close() {
 	c.once.Do(func() {
-		if c.conn == nil {
+		c.Lock()
+		conn := c.conn
+		if conn != nil {
+			// graceful close connection
+			c.sendClose(conn)
+		}
+		c.Unlock()
+		if conn == nil {
 			return
 		}
-		// graceful close connection
-		_ = WriteFrame(c.conn, sun.OpClose, nil)
-
-		c.conn.Close()
+		conn.Close()
 		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 	})
 }
 
+// Read 读取一个帧，迁移通知会被Read处理而不会返回给调用方：
+// 在随机延迟之前照常读取旧连接上的消息，之后重连到新的节点并关闭旧的连接
 func (c *Client) Read() (sun.Frame, error) {
 	if c.conn == nil {
 		return nil, errors.New("connection is nil")
 	}
+	for {
+		frame, err := c.readFrame()
+		if c.target != "" && (err != nil || frame.GetOpCode() == sun.OpClose) {
+			// 旧连接超时或者被服务端关闭
+			if err = c.migrate(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if frame.GetOpCode() == sun.OpClose {
+			return nil, errors.New("remote side close the channel")
+		}
+		if frame.GetOpCode() == sun.OpBinary {
+			if r, ok := pkt.ReadRedirect(frame.GetPayload()); ok {
+				c.redirect(r)
+				continue
+			}
+		}
+		return frame, nil
+	}
+}
+
+func (c *Client) readFrame() (sun.Frame, error) {
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+	var deadline time.Time
 	if c.options.Heartbeat > 0 {
-		_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+		deadline = time.Now().Add(c.options.ReadWait)
 	}
-	frame, err := c.conn.ReadFrame()
+	if c.target != "" && (deadline.IsZero() || c.redirectAt.Before(deadline)) {
+		deadline = c.redirectAt
+	}
+	if !deadline.IsZero() {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	return conn.ReadFrame()
+}
+
+// redirect 在时间窗口之内随机选择一个重连的时间点
+func (c *Client) redirect(r *pkt.Redirect) {
+	window := r.Window
+	if window <= 0 {
+		window = c.options.RedirectWindow
+	}
+	var delay time.Duration
+	if window > 0 {
+		delay = time.Duration(rand.Int63n(int64(window)))
+	}
+	logger.WithField("module", "tcp.client").Infof("%s redirect to %s after %v", c.id, r.Address, delay)
+	c.target = r.Address
+	c.redirectAt = time.Now().Add(delay)
+}
+
+// migrate 等到redirectAt之后连接到新的节点，替换并关闭旧的连接
+func (c *Client) migrate() error {
+	time.Sleep(time.Until(c.redirectAt))
+	target := c.target
+	c.target = ""
+	conn, err := c.dial(target)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if frame.GetOpCode() == sun.OpClose {
-		return nil, errors.New("remote side close the channel")
+	c.Lock()
+	old := c.conn
+	c.conn = conn
+	c.sendClose(old)
+	c.Unlock()
+	return old.Close()
+}
+
+// sendClose 通过conn的写缓冲区发送OpClose并Flush，需要持有锁，
+// 避免与Send、ping的写入交错
+func (c *Client) sendClose(conn sun.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	if err := conn.WriteFrame(sun.OpClose, nil); err == nil {
+		_ = conn.Flush()
+	}
+}
+
+// ReadPkt 读取并解码一个消息包，控制帧会被跳过
+func (c *Client) ReadPkt() (interface{}, error) {
+	for {
+		frame, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if frame.GetOpCode() != sun.OpBinary {
+			continue
+		}
+		return pkt.Read(bytes.NewReader(frame.GetPayload()))
 	}
-	return frame, nil
 }
 
 func (c *Client) heartbealoop() error {
@@ -157,10 +290,15 @@ func (c *Client) heartbealoop() error {
 
 func (c *Client) ping() error {
 	logger.WithField("module", "tcp.client").Tracef("%s send ping to server", c.id)
+	c.Lock()
+	defer c.Unlock()
 
 	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
 	if err != nil {
 		return err
 	}
-	return c.conn.WriteFrame(sun.OpPing, nil)
+	if err = c.conn.WriteFrame(sun.OpPing, nil); err != nil {
+		return err
+	}
+	return c.conn.Flush()
 }
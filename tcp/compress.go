@@ -0,0 +1,71 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	sun "github.com/sunrnalike/sun"
+)
+
+// default compression options
+const (
+	DefaultCompressLevel     = flate.BestSpeed
+	DefaultCompressThreshold = 256
+)
+
+// CompressLevel与CompressThreshold的零值表示使用默认值，
+// 需要不压缩或者压缩所有payload时使用下面的值
+const (
+	// NoCompression 作为CompressLevel时使用flate.NoCompression
+	NoCompression = -3
+	// CompressAll 作为CompressThreshold时压缩所有的payload，小于0的值都是如此
+	CompressAll = -1
+)
+
+// compressOptions 把零值替换为默认值，并把NoCompression映射为flate.NoCompression
+func compressOptions(level, threshold int) (int, int) {
+	switch level {
+	case 0:
+		level = DefaultCompressLevel
+	case NoCompression:
+		level = flate.NoCompression
+	}
+	if threshold == 0 {
+		threshold = DefaultCompressThreshold
+	} else if threshold < 0 {
+		threshold = 0
+	}
+	return level, threshold
+}
+
+func compress(payload []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress 解压payload，解压后的长度不能超过limit，防止压缩炸弹
+func decompress(payload []byte, limit int) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(payload))
+	defer fr.Close()
+	// 多读一个字节用来判断是否超过限制
+	buf, err := io.ReadAll(io.LimitReader(fr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, fmt.Errorf("%w: decompressed payload exceeds limit %d", sun.ErrFrameTooLarge, limit)
+	}
+	return buf, nil
+}
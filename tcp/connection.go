@@ -1,13 +1,34 @@
 package tcp
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	sun "github.com/sunrnalike/sun"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sunrnalike/sun/wire/endian"
 )
 
+// 帧头的版本保存在第一个字节的高4位，低4位是OpCode
+const (
+	// FrameVersion0 [opcode u8][len u32][payload]
+	FrameVersion0 = 0
+	// FrameVersion1 [version<<4|opcode u8][flags u8][len u32][payload]
+	FrameVersion1 = 1
+)
+
+// flags of FrameVersion1
+const (
+	// FlagCompressed payload使用compress/flate压缩
+	FlagCompressed uint8 = 1 << 0
+	// FlagCompressAccept 发送方可以解压收到的payload
+	FlagCompressAccept uint8 = 1 << 1
+)
+
 // Frame Frame
 type Frame struct {
 	OpCode  sun.OpCode
@@ -34,42 +55,227 @@ func (f *Frame) GetPayload() []byte {
 	return f.Payload
 }
 
+// ConnOptions ConnOptions
+type ConnOptions struct {
+	MaxFrameSize    int // 单个帧payload的最大长度，超过时ReadFrame返回sun.ErrFrameTooLarge
+	WriteBufferSize int // 写缓冲区大小
+	// Compress 对端在帧头中声明了FlagCompressAccept之后，
+	// 超过CompressThreshold的payload会被压缩发送
+	Compress          bool
+	CompressLevel     int // compress/flate的压缩级别，0为DefaultCompressLevel，不压缩时使用NoCompression
+	CompressThreshold int // 超过该长度的payload才会被压缩，0为DefaultCompressThreshold，小于0时全部压缩
+	// PooledWriteBuffer 写缓冲区在写入时从池中获取，Flush之后归还，
+	// 用于大量空闲连接的场景，空闲连接不再各自持有一个写缓冲区
+	PooledWriteBuffer bool
+}
+
 // Conn Conn
 type TcpConn struct {
 	net.Conn
+	options      ConnOptions
+	bw           *bufio.Writer
+	peerCompress int32 // 对端是否可以解压
 }
 
 // NewConn NewConn
 func NewConn(conn net.Conn) *TcpConn {
-	return &TcpConn{
-		Conn: conn,
+	return NewConnWithOptions(conn, ConnOptions{})
+}
+
+// NewConnWithOptions NewConnWithOptions
+func NewConnWithOptions(conn net.Conn, opts ConnOptions) *TcpConn {
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = sun.DefaultMaxFrameSize
 	}
+	if opts.WriteBufferSize <= 0 {
+		opts.WriteBufferSize = sun.DefaultWriteBufferSize
+	}
+	opts.CompressLevel, opts.CompressThreshold = compressOptions(opts.CompressLevel, opts.CompressThreshold)
+	c := &TcpConn{
+		Conn:    conn,
+		options: opts,
+	}
+	if !opts.PooledWriteBuffer {
+		c.bw = bufio.NewWriterSize(conn, opts.WriteBufferSize)
+	}
+	return c
+}
+
+var writerPools sync.Map // size -> *sync.Pool
+
+func writerPool(size int) *sync.Pool {
+	pool, _ := writerPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			return bufio.NewWriterSize(nil, size)
+		},
+	})
+	return pool.(*sync.Pool)
 }
 
-// ReadFrame ReadFrame
+// writer 返回写缓冲区，PooledWriteBuffer时从池中获取
+func (c *TcpConn) writer() *bufio.Writer {
+	if c.bw == nil {
+		c.bw = writerPool(c.options.WriteBufferSize).Get().(*bufio.Writer)
+		c.bw.Reset(c.Conn)
+	}
+	return c.bw
+}
+
+// ReadFrame 读取一个帧，兼容FrameVersion0和FrameVersion1两种帧头
 func (c *TcpConn) ReadFrame() (sun.Frame, error) {
-	opcode, err := endian.ReadUint8(c.Conn)
+	head, err := endian.ReadUint8(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	var flags uint8
+	switch head >> 4 {
+	case FrameVersion0:
+	case FrameVersion1:
+		if flags, err = endian.ReadUint8(c.Conn); err != nil {
+			return nil, err
+		}
+		if flags&FlagCompressAccept != 0 {
+			atomic.StoreInt32(&c.peerCompress, 1)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported frame version %d", head>>4)
+	}
+	// 先校验长度再分配内存，防止恶意的长度前缀耗尽内存
+	length, err := endian.ReadUint32(c.Conn)
 	if err != nil {
 		return nil, err
 	}
-	payload, err := endian.ReadBytes(c.Conn)
+	if uint64(length) > uint64(c.options.MaxFrameSize) {
+		return nil, fmt.Errorf("%w: %d exceeds limit %d", sun.ErrFrameTooLarge, length, c.options.MaxFrameSize)
+	}
+	payload, err := endian.ReadFixedBytes(int(length), c.Conn)
 	if err != nil {
 		return nil, err
 	}
+	if flags&FlagCompressed != 0 {
+		if payload, err = decompress(payload, c.options.MaxFrameSize); err != nil {
+			return nil, err
+		}
+	}
 	return &Frame{
-		OpCode:  sun.OpCode(opcode),
+		OpCode:  sun.OpCode(head & 0x0f),
 		Payload: payload,
 	}, nil
 }
 
-// WriteFrame WriteFrame
+// decodeFrame 从buf中解析一个完整的帧，返回帧与消耗的字节数，数据不完整时返回(nil, 0, nil)。
+// 用于netpoll模式下非阻塞地读取，payload会被复制，buf可以被复用
+func (c *TcpConn) decodeFrame(buf []byte) (sun.Frame, int, error) {
+	if len(buf) < 1 {
+		return nil, 0, nil
+	}
+	head := buf[0]
+	offset := 1
+	var flags uint8
+	switch head >> 4 {
+	case FrameVersion0:
+	case FrameVersion1:
+		if len(buf) < 2 {
+			return nil, 0, nil
+		}
+		flags = buf[1]
+		offset = 2
+	default:
+		return nil, 0, fmt.Errorf("unsupported frame version %d", head>>4)
+	}
+	if len(buf) < offset+4 {
+		return nil, 0, nil
+	}
+	length := endian.Default.Uint32(buf[offset:])
+	offset += 4
+	// 长度前缀完整之后立即校验，不需要等待整个帧
+	if uint64(length) > uint64(c.options.MaxFrameSize) {
+		return nil, 0, fmt.Errorf("%w: %d exceeds limit %d", sun.ErrFrameTooLarge, length, c.options.MaxFrameSize)
+	}
+	end := offset + int(length)
+	if len(buf) < end {
+		return nil, 0, nil
+	}
+	if flags&FlagCompressAccept != 0 {
+		atomic.StoreInt32(&c.peerCompress, 1)
+	}
+	payload := make([]byte, length)
+	copy(payload, buf[offset:end])
+	if flags&FlagCompressed != 0 {
+		var err error
+		if payload, err = decompress(payload, c.options.MaxFrameSize); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &Frame{
+		OpCode:  sun.OpCode(head & 0x0f),
+		Payload: payload,
+	}, end, nil
+}
+
+// WriteFrame 把帧写入缓冲区，调用Flush之后才会发送。
+// 只有双方都开启了压缩时才会使用FrameVersion1，因此老版本的对端不受影响
 func (c *TcpConn) WriteFrame(code sun.OpCode, payload []byte) error {
-	return WriteFrame(c.Conn, code, payload)
+	return c.encodeFrame(c.writer(), c.preparedKey(), code, payload)
+}
+
+// preparedKey 帧的编码结果只与是否压缩及压缩参数有关
+type preparedKey struct {
+	compress  bool
+	level     int
+	threshold int
+}
+
+func (c *TcpConn) preparedKey() preparedKey {
+	if !c.options.Compress || atomic.LoadInt32(&c.peerCompress) == 0 {
+		return preparedKey{}
+	}
+	return preparedKey{true, c.options.CompressLevel, c.options.CompressThreshold}
+}
+
+func (c *TcpConn) encodeFrame(w io.Writer, key preparedKey, code sun.OpCode, payload []byte) error {
+	if !key.compress {
+		return WriteFrame(w, code, payload)
+	}
+	flags := FlagCompressAccept
+	if len(payload) >= key.threshold {
+		compressed, err := compress(payload, key.level)
+		if err != nil {
+			return err
+		}
+		payload = compressed
+		flags |= FlagCompressed
+	}
+	return WriteFrameWithFlags(w, code, flags, payload)
+}
+
+// WritePrepared 写入一个预先编码的帧，压缩参数相同的连接共享同一份编码结果
+func (c *TcpConn) WritePrepared(frame *sun.PreparedFrame) error {
+	key := c.preparedKey()
+	data, err := frame.Encode(key, func(payload []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		err := c.encodeFrame(&buf, key, sun.OpBinary, payload)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.writer().Write(data)
+	return err
 }
 
-// Flush Flush
+// Flush 把缓冲区中的数据一次性写入连接
 func (c *TcpConn) Flush() error {
-	return nil
+	if c.bw == nil {
+		return nil
+	}
+	err := c.bw.Flush()
+	if c.options.PooledWriteBuffer {
+		c.bw.Reset(nil)
+		writerPool(c.options.WriteBufferSize).Put(c.bw)
+		c.bw = nil
+	}
+	return err
 }
 
 // WriteFrame write a frame to w
@@ -82,3 +288,18 @@ func WriteFrame(w io.Writer, code sun.OpCode, payload []byte) error {
 	}
 	return nil
 }
+
+// WriteFrameWithFlags 使用FrameVersion1的帧头写一个帧。
+// Dialer可以在握手帧中设置FlagCompressAccept，向服务端声明支持压缩
+func WriteFrameWithFlags(w io.Writer, code sun.OpCode, flags uint8, payload []byte) error {
+	if err := endian.WriteUint8(w, FrameVersion1<<4|uint8(code)); err != nil {
+		return err
+	}
+	if err := endian.WriteUint8(w, flags); err != nil {
+		return err
+	}
+	if err := endian.WriteBytes(w, payload); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+func TestReadFrameTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		// 只发送一个伪造的长度前缀，不发送payload
+		_ = endian.WriteUint8(cli, uint8(sun.OpBinary))
+		_ = endian.WriteUint32(cli, 0xffffffff)
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{MaxFrameSize: 1024})
+	_, err := conn.ReadFrame()
+	if !errors.Is(err, sun.ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestReadFrameWithinLimit(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		_ = WriteFrame(cli, sun.OpBinary, []byte("hello"))
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{MaxFrameSize: 5})
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.GetPayload()) != "hello" {
+		t.Fatalf("unexpected payload %s", frame.GetPayload())
+	}
+}
+
+// countConn 统计Write调用次数，每次Write对应一次系统调用
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func (c *countConn) SetWriteDeadline(t time.Time) error { return nil }
+
+const (
+	fanout    = 100 // 模拟一次推送到100个连接
+	batchSize = 8   // 每个连接队列中积压的消息数
+)
+
+var benchPayload = make([]byte, 256)
+
+func BenchmarkFanoutUnbuffered(b *testing.B) {
+	conns := make([]*countConn, fanout)
+	for i := range conns {
+		conns[i] = &countConn{}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, conn := range conns {
+			for i := 0; i < batchSize; i++ {
+				_ = WriteFrame(conn, sun.OpBinary, benchPayload)
+			}
+		}
+	}
+	b.StopTimer()
+	reportWrites(b, conns)
+}
+
+func BenchmarkFanoutBuffered(b *testing.B) {
+	counters := make([]*countConn, fanout)
+	conns := make([]*TcpConn, fanout)
+	for i := range conns {
+		counters[i] = &countConn{}
+		conns[i] = NewConn(counters[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, conn := range conns {
+			for i := 0; i < batchSize; i++ {
+				_ = conn.WriteFrame(sun.OpBinary, benchPayload)
+			}
+			_ = conn.Flush()
+		}
+	}
+	b.StopTimer()
+	reportWrites(b, counters)
+}
+
+func reportWrites(b *testing.B, conns []*countConn) {
+	total := 0
+	for _, conn := range conns {
+		total += conn.writes
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "syscalls/op")
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	payload := make([]byte, 1024)
+	server := NewConnWithOptions(srv, ConnOptions{Compress: true, CompressThreshold: 512})
+	client := NewConnWithOptions(cli, ConnOptions{Compress: true})
+
+	go func() {
+		// 握手帧中声明支持压缩
+		_ = WriteFrameWithFlags(cli, sun.OpBinary, FlagCompressAccept, []byte("u1"))
+	}()
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_ = server.WriteFrame(sun.OpBinary, payload)
+		_ = server.Flush()
+	}()
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(cli, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[0]>>4 != FrameVersion1 || head[1]&FlagCompressed == 0 {
+		t.Fatalf("expect a compressed frame, got header %v", head)
+	}
+	length := endian.Default.Uint32(head[2:])
+	if length >= uint32(len(payload)) {
+		t.Fatalf("payload is not compressed: %d", length)
+	}
+	if _, err := io.ReadFull(cli, make([]byte, length)); err != nil {
+		t.Fatal(err)
+	}
+	<-written
+
+	go func() {
+		_ = server.WriteFrame(sun.OpBinary, payload)
+		_ = server.Flush()
+	}()
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.GetPayload()) != len(payload) {
+		t.Fatalf("unexpected payload length %d", len(frame.GetPayload()))
+	}
+}
+
+func TestCompressWithLegacyPeer(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	server := NewConnWithOptions(srv, ConnOptions{Compress: true, CompressThreshold: 1})
+	go func() {
+		_ = WriteFrame(cli, sun.OpBinary, []byte("u1"))
+	}()
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.WriteFrame(sun.OpBinary, []byte("hello"))
+		_ = server.Flush()
+	}()
+	// 老版本的客户端只能解析FrameVersion0
+	opcode, err := endian.ReadUint8(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := endian.ReadBytes(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sun.OpCode(opcode) != sun.OpBinary || string(payload) != "hello" {
+		t.Fatalf("unexpected frame %d %s", opcode, payload)
+	}
+}
+
+// bufConn 把写入的数据保存在buf中
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestWritePrepared(t *testing.T) {
+	payload := bytes.Repeat([]byte("hello kim "), 100)
+	frame := sun.NewPreparedFrame(payload)
+	for _, compress := range []bool{false, true} {
+		var conns [2]*bufConn
+		for i := range conns {
+			conns[i] = &bufConn{}
+			conn := NewConnWithOptions(conns[i], ConnOptions{Compress: true})
+			if compress {
+				atomic.StoreInt32(&conn.peerCompress, 1)
+			}
+			_ = conn.WritePrepared(frame)
+			_ = conn.Flush()
+		}
+		expect := &bufConn{}
+		conn := NewConnWithOptions(expect, ConnOptions{Compress: true})
+		if compress {
+			atomic.StoreInt32(&conn.peerCompress, 1)
+		}
+		_ = conn.WriteFrame(sun.OpBinary, payload)
+		_ = conn.Flush()
+		for _, c := range conns {
+			if !bytes.Equal(c.buf.Bytes(), expect.buf.Bytes()) {
+				t.Fatalf("compress %v: prepared frame differs from WriteFrame", compress)
+			}
+		}
+	}
+	// 两种编码都已经缓存，不会再次编码
+	for _, key := range []preparedKey{{}, {true, DefaultCompressLevel, DefaultCompressThreshold}} {
+		if _, err := frame.Encode(key, func([]byte) ([]byte, error) {
+			return nil, errors.New("encoded twice")
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompressOptions(t *testing.T) {
+	level, threshold := compressOptions(0, 0)
+	if level != DefaultCompressLevel || threshold != DefaultCompressThreshold {
+		t.Fatalf("unexpected defaults %d %d", level, threshold)
+	}
+	level, threshold = compressOptions(NoCompression, CompressAll)
+	if level != flate.NoCompression || threshold != 0 {
+		t.Fatalf("unexpected options %d %d", level, threshold)
+	}
+
+	// CompressAll时一个字节的payload也会被压缩
+	out := &bufConn{}
+	conn := NewConnWithOptions(out, ConnOptions{Compress: true, CompressLevel: NoCompression, CompressThreshold: CompressAll})
+	atomic.StoreInt32(&conn.peerCompress, 1)
+	_ = conn.WriteFrame(sun.OpBinary, []byte("a"))
+	_ = conn.Flush()
+	head := out.buf.Next(6)
+	if head[0]>>4 != FrameVersion1 || head[1]&FlagCompressed == 0 {
+		t.Fatalf("expect a compressed frame, got header %v", head)
+	}
+	payload, err := decompress(out.buf.Bytes(), 1024)
+	if err != nil || string(payload) != "a" {
+		t.Fatalf("unexpected payload %q %v", payload, err)
+	}
+}
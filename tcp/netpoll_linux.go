@@ -0,0 +1,294 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+)
+
+var (
+	errIdleTimeout = errors.New("read timeout")
+	errShutdown    = errors.New(sun.CloseReasonShutdown)
+	errClosed      = errors.New("channel closed")
+)
+
+// pollReadSize worker每次从连接中读取的最大字节数
+const pollReadSize = 64 * 1024
+
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller 使用epoll监听所有连接的可读事件，连接可读时交给worker协程非阻塞地读取已经到达的数据，
+// 只分发完整的帧，不完整的部分保存在连接自己的缓冲区中，发送缓慢的客户端不会阻塞worker。
+// 每个fd使用EPOLLONESHOT注册，处理完之后重新注册，因此同一个连接不会被并发读取
+type poller struct {
+	epfd      int
+	seq       int32
+	mu        sync.Mutex
+	entries   map[int]*pollEntry
+	jobs      chan *pollEntry
+	lst       sun.MessageListener
+	frameWait time.Duration
+	onClose   func(*sun.PollChannel, error)
+	done      *sun.Event
+}
+
+type pollEntry struct {
+	fd        int
+	seq       int32 // 区分fd被复用之前的事件
+	rc        syscall.RawConn
+	conn      *TcpConn
+	ch        *sun.PollChannel
+	timer     *time.Timer // 超过readwait没有可读数据，或者不完整的帧超过frameWait时关闭
+	pending   []byte      // 还不完整的帧，只在worker中访问
+	partialAt time.Time   // pending中的帧开始到达的时间
+	closed    int32
+}
+
+// newPoller frameWait为一个帧从开始到达到接收完整的最长时间
+func newPoller(workers int, lst sun.MessageListener, frameWait time.Duration, onClose func(*sun.PollChannel, error)) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{
+		epfd:      epfd,
+		entries:   make(map[int]*pollEntry),
+		jobs:      make(chan *pollEntry, workers*64),
+		lst:       lst,
+		frameWait: frameWait,
+		onClose:   onClose,
+		done:      sun.NewEvent(),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.wait()
+	return p, nil
+}
+
+// add 注册一个完成握手的连接，之后的读取都由poller驱动。
+// conn是tc底层的连接，不能在用户态缓存任何还没有读取的数据
+func (p *poller) add(conn net.Conn, tc *TcpConn, ch *sun.PollChannel) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("tcp: netpoll requires a syscall.Conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	if err = rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+	e := &pollEntry{
+		fd:   fd,
+		seq:  atomic.AddInt32(&p.seq, 1),
+		rc:   rc,
+		conn: tc,
+		ch:   ch,
+	}
+	e.timer = time.AfterFunc(ch.ReadWait(), func() {
+		p.close(e, errIdleTimeout)
+	})
+
+	p.mu.Lock()
+	p.entries[fd] = e
+	if err = p.ctl(syscall.EPOLL_CTL_ADD, e); err != nil {
+		delete(p.entries, fd)
+		p.mu.Unlock()
+		e.timer.Stop()
+		return err
+	}
+	p.mu.Unlock()
+	// Kick等在外部调用Close时，注销连接并回调onClose
+	ch.OnClose(func() {
+		p.close(e, errClosed)
+	})
+	return nil
+}
+
+func (p *poller) ctl(op int, e *pollEntry) error {
+	ev := syscall.EpollEvent{Events: pollEvents, Fd: int32(e.fd), Pad: e.seq}
+	return syscall.EpollCtl(p.epfd, op, e.fd, &ev)
+}
+
+func (p *poller) wait() {
+	events := make([]syscall.EpollEvent, 256)
+	for !p.done.HasFired() {
+		// 使用超时而不是无限等待，stop之后可以退出
+		n, err := syscall.EpollWait(p.epfd, events, 1000)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			break
+		}
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			e, ok := p.entries[int(events[i].Fd)]
+			p.mu.Unlock()
+			if !ok || e.seq != events[i].Pad {
+				continue
+			}
+			select {
+			case p.jobs <- e:
+			case <-p.done.Done():
+				return
+			}
+		}
+	}
+	_ = syscall.Close(p.epfd)
+}
+
+func (p *poller) work() {
+	buf := make([]byte, pollReadSize)
+	for {
+		select {
+		case e := <-p.jobs:
+			if err := p.handle(e, buf); err != nil {
+				p.close(e, err)
+				continue
+			}
+			wait := e.ch.ReadWait()
+			if len(e.pending) > 0 {
+				left := p.frameWait - time.Since(e.partialAt)
+				if left <= 0 {
+					p.close(e, errIdleTimeout)
+					continue
+				}
+				if left < wait {
+					wait = left
+				}
+			}
+			e.timer.Reset(wait)
+			p.rearm(e)
+		case <-p.done.Done():
+			return
+		}
+	}
+}
+
+// handle 读取连接中已经到达的数据并分发其中完整的帧，没有更多数据时返回
+func (p *poller) handle(e *pollEntry, buf []byte) error {
+	for {
+		n, err := e.read(buf)
+		if err != nil || n == 0 {
+			return err
+		}
+		data := buf[:n]
+		if len(e.pending) > 0 {
+			data = append(e.pending, data...)
+		}
+		consumed := 0
+		for {
+			frame, size, err := e.conn.decodeFrame(data[consumed:])
+			if err != nil {
+				if errors.Is(err, sun.ErrFrameTooLarge) {
+					_ = e.ch.WriteFrame(sun.OpClose, []byte(err.Error()))
+				}
+				return err
+			}
+			if frame == nil {
+				break
+			}
+			consumed += size
+			if err = e.ch.Dispatch(p.lst, frame); err != nil {
+				return err
+			}
+		}
+		if rest := data[consumed:]; len(rest) == 0 {
+			e.pending = nil
+		} else {
+			// 新的帧开始到达时重新计时
+			if len(e.pending) == 0 || consumed > 0 {
+				e.partialAt = time.Now()
+			}
+			e.pending = append([]byte(nil), rest...)
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// read 非阻塞地读取，没有可读数据时返回(0, nil)
+func (e *pollEntry) read(buf []byte) (int, error) {
+	var (
+		n    int
+		rerr error
+	)
+	err := e.rc.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), buf)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case rerr == syscall.EAGAIN || rerr == syscall.EINTR:
+		return 0, nil
+	case rerr != nil:
+		return 0, rerr
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// rearm 重新注册可读事件，连接已经关闭时忽略，防止修改到复用了这个fd的新连接
+func (p *poller) rearm(e *pollEntry) {
+	p.mu.Lock()
+	if p.entries[e.fd] != e {
+		p.mu.Unlock()
+		return
+	}
+	err := p.ctl(syscall.EPOLL_CTL_MOD, e)
+	p.mu.Unlock()
+	if err != nil {
+		p.close(e, err)
+	}
+}
+
+// close 先从epoll中删除，再通过onClose关闭连接，之后fd才可能被复用
+// onClose中会再次调用ch.Close，通过OnClose回到这里时直接返回
+func (p *poller) close(e *pollEntry, err error) {
+	if !atomic.CompareAndSwapInt32(&e.closed, 0, 1) {
+		return
+	}
+	e.timer.Stop()
+	p.mu.Lock()
+	if p.entries[e.fd] == e {
+		delete(p.entries, e.fd)
+		_ = p.ctl(syscall.EPOLL_CTL_DEL, e)
+	}
+	p.mu.Unlock()
+	p.onClose(e.ch, err)
+}
+
+// closeAll 关闭所有已经注册的连接，每个连接都会回调onClose
+func (p *poller) closeAll() {
+	p.mu.Lock()
+	entries := make([]*pollEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	p.mu.Unlock()
+	for _, e := range entries {
+		p.close(e, errShutdown)
+	}
+}
+
+// stop 停止事件循环与worker，已经注册的连接由Server关闭
+func (p *poller) stop() {
+	p.done.Fire()
+}
@@ -0,0 +1,236 @@
+package tcp
+
+import (
+	"context"
+	"flag"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/proxyproto"
+)
+
+func TestNetpoll(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithNetpoll(2))
+	lst := &pollListener{disconnected: make(chan string, 2)}
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	srv.SetReadWait(time.Millisecond * 300)
+	go func() {
+		_ = srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	_, port, _ := net.SplitHostPort(addr)
+	cli := NewClient("c1", "client", ClientOptions{})
+	cli.SetDialer(&tlsDialer{})
+	if err := cli.Connect("localhost:" + port); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	for i := 0; i < 3; i++ {
+		if err := cli.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := cli.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(frame.GetPayload()), ":hello") {
+			t.Fatalf("unexpected payload %q", frame.GetPayload())
+		}
+	}
+
+	// 超过readwait没有可读数据时关闭连接
+	select {
+	case <-lst.disconnected:
+	case <-time.After(time.Second * 2):
+		t.Fatal("idle connection is not closed")
+	}
+	if _, err := cli.Read(); err == nil {
+		t.Fatal("expect connection closed")
+	}
+}
+
+// startPollServer 只有一个worker的netpoll服务端，握手帧的payload是channelId
+func startPollServer(t *testing.T) (*Server, string, *pollListener) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithNetpoll(1), WithLoginWait(time.Millisecond*500)).(*Server)
+	lst := &pollListener{disconnected: make(chan string, 2)}
+	srv.SetAcceptor(&frameAcceptor{})
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	srv.SetReadWait(time.Minute)
+	go func() {
+		_ = srv.Start()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown(context.Background())
+	})
+	time.Sleep(time.Millisecond * 100)
+	return srv, addr, lst
+}
+
+func pollLogin(t *testing.T, addr, id string) net.Conn {
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rawconn.Close()
+	})
+	_ = rawconn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if err = WriteFrame(rawconn, sun.OpBinary, []byte(id)); err != nil {
+		t.Fatal(err)
+	}
+	return rawconn
+}
+
+func TestNetpollOptionalProxy(t *testing.T) {
+	srv := NewServer(freeAddr(t), &naming.DefaultService{Id: "srv1"}, WithNetpoll(1), WithProxyProtocol(proxyproto.ModeOptional))
+	srv.SetStateListener(&pollListener{})
+	if err := srv.Start(); err == nil {
+		t.Fatal("netpoll should reject proxyproto.ModeOptional")
+	}
+}
+
+func TestNetpollSlowSender(t *testing.T) {
+	srv, addr, lst := startPollServer(t)
+	slow := pollLogin(t, addr, "slow")
+	fast := pollLogin(t, addr, "fast")
+	for i := 0; i < 100 && srv.Len() < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 只发送半个帧，唯一的worker不能阻塞在这个连接上
+	frame := new(strings.Builder)
+	_ = WriteFrame(frame, sun.OpBinary, []byte("hello"))
+	_, _ = slow.Write([]byte(frame.String()[:3]))
+	time.Sleep(time.Millisecond * 50)
+
+	start := time.Now()
+	// 一个帧分多次到达时也能正确解析
+	for _, part := range []string{frame.String()[:2], frame.String()[2:]} {
+		_, _ = fast.Write([]byte(part))
+		time.Sleep(time.Millisecond * 10)
+	}
+	resp, err := NewConn(fast).ReadFrame()
+	if err != nil || string(resp.GetPayload()) != "fast:hello" {
+		t.Fatalf("unexpected response %v %v", resp, err)
+	}
+	if time.Since(start) > time.Millisecond*300 {
+		t.Fatal("a slow sender stalls the worker")
+	}
+
+	// 不完整的帧超过frameWait之后关闭连接
+	select {
+	case id := <-lst.disconnected:
+		if id != "slow" {
+			t.Fatalf("disconnected %s, want slow", id)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("slow sender is not closed")
+	}
+}
+
+func TestNetpollKick(t *testing.T) {
+	srv, addr, lst := startPollServer(t)
+	conn := pollLogin(t, addr, "c1")
+	for i := 0; i < 100 && srv.Len() < 1; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	ch, _ := srv.Get("c1")
+	_ = ch.Close()
+
+	// 外部关闭之后立即注销，不需要等待readwait
+	select {
+	case id := <-lst.disconnected:
+		if id != "c1" {
+			t.Fatalf("disconnected %s, want c1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+	if _, err := NewConn(conn).ReadFrame(); err == nil {
+		t.Fatal("expect connection closed")
+	}
+	if srv.Len() != 0 {
+		t.Fatalf("%d channels left", srv.Len())
+	}
+}
+
+var idleConns = flag.Int("idle.conns", 100000, "number of idle connections in BenchmarkIdleConns")
+
+// BenchmarkIdleConns 对比两种模式下每个空闲连接占用的内存与协程，100k个连接需要20万以上的文件句柄：
+//
+//	ulimit -n 250000
+//	go test -run NONE -bench IdleConns -benchtime 1x ./tcp
+func BenchmarkIdleConns(b *testing.B) {
+	b.Run("goroutine", func(b *testing.B) {
+		benchmarkIdleConns(b)
+	})
+	b.Run("netpoll", func(b *testing.B) {
+		benchmarkIdleConns(b, WithNetpoll(0))
+	})
+}
+
+func benchmarkIdleConns(b *testing.B, options ...ServerOption) {
+	n := *idleConns
+	var rlim syscall.Rlimit
+	_ = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim)
+	if rlim.Cur < uint64(2*n+100) {
+		b.Skipf("%d idle connections need %d open files, limit is %d", n, 2*n+100, rlim.Cur)
+	}
+	for i := 0; i < b.N; i++ {
+		// 使用unix domain socket，不受本地端口数量的限制
+		addr := UnixScheme + filepath.Join(b.TempDir(), "idle.sock")
+		srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, options...)
+		srv.SetReadWait(time.Hour)
+		srv.SetMessageListener(&echoListener{})
+		srv.SetStateListener(&echoListener{})
+		go func() {
+			_ = srv.Start()
+		}()
+		time.Sleep(time.Millisecond * 100)
+
+		before := memUsage()
+		goroutines := runtime.NumGoroutine()
+		conns := make([]net.Conn, 0, n)
+		for len(conns) < n {
+			conn, err := Dial(addr, time.Second, nil)
+			if err != nil {
+				// accept队列已满
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+		channels := srv.(*Server).ChannelMap
+		for channels.Len() < n {
+			time.Sleep(time.Millisecond * 50)
+		}
+		after := memUsage()
+
+		b.ReportMetric(float64(after-before)/float64(n), "B/conn")
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(n), "goroutines/conn")
+		for _, conn := range conns {
+			conn.Close()
+		}
+		_ = srv.Shutdown(context.Background())
+	}
+}
+
+// memUsage 堆与协程栈占用的内存
+func memUsage() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse + m.StackInuse
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+)
+
+// poller 只在linux上实现
+type poller struct{}
+
+func newPoller(workers int, lst sun.MessageListener, frameWait time.Duration, onClose func(*sun.PollChannel, error)) (*poller, error) {
+	return nil, errors.New("tcp: netpoll is only supported on linux")
+}
+
+func (p *poller) add(conn net.Conn, tc *TcpConn, ch *sun.PollChannel) error {
+	return errors.New("tcp: netpoll is only supported on linux")
+}
+
+func (p *poller) closeAll() {}
+
+func (p *poller) stop() {}
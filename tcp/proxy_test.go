@@ -0,0 +1,94 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/proxyproto"
+)
+
+type addrAcceptor struct{}
+
+func (a *addrAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: conn.RemoteAddr().String()}, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithProxyProtocol(proxyproto.ModeRequired))
+	srv.SetAcceptor(&addrAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn.Close()
+	_, _ = rawconn.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 8000\r\n"))
+	conn := NewConn(rawconn)
+	if err = WriteFrame(conn, sun.OpBinary, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(frame.GetPayload()); got != "1.2.3.4:5678:hi" {
+		t.Fatalf("unexpected payload %q", got)
+	}
+
+	// 没有头部的连接被关闭
+	rawconn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn2.Close()
+	_ = WriteFrame(rawconn2, sun.OpBinary, []byte("hi"))
+	_ = rawconn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = NewConn(rawconn2).ReadFrame(); err == nil {
+		t.Fatal("expect connection closed")
+	}
+}
+
+func TestProxyProtocolLoginWait(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"},
+		WithProxyProtocol(proxyproto.ModeRequired), WithLoginWait(time.Millisecond*300))
+	srv.SetAcceptor(&frameAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn.Close()
+	// 头部与鉴权帧分别在loginwait之内到达，但总时间超过了loginwait
+	time.Sleep(time.Millisecond * 200)
+	_, _ = rawconn.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 8000\r\n"))
+	time.Sleep(time.Millisecond * 200)
+	_ = WriteFrame(rawconn, sun.OpBinary, []byte("u1"))
+
+	_ = rawconn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := NewConn(rawconn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetOpCode() != sun.OpClose || string(frame.GetPayload()) != sun.ErrLoginTimeout.Error() {
+		t.Fatalf("unexpected frame %d %q", frame.GetOpCode(), frame.GetPayload())
+	}
+}
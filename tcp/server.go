@@ -2,27 +2,133 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	sun "github.com/sunrnalike/sun"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/sunrnalike/sun/logger"
 	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/proxyproto"
 
 	"github.com/segmentio/ksuid"
 )
 
 // ServerOptions ServerOptions
 type ServerOptions struct {
-	loginwait time.Duration //登陆超时
-	readwait  time.Duration //读超时
-	writewait time.Duration //读超时
+	loginwait    time.Duration //登陆超时
+	readwait     time.Duration //读超时
+	writewait    time.Duration //读超时
+	maxFrameSize int           //单个帧payload的最大长度
+	writeBuffer  int           //写缓冲区大小
+	compress     bool          //客户端声明支持时压缩下行消息
+	compressLvl  int           //压缩级别
+	compressMin  int           //超过该长度的消息才会被压缩
+	tlsConfig    *tls.Config   //不为nil时使用TLS
+	netpoll      bool          //使用epoll驱动读取
+	pollWorkers  int           //netpoll模式下处理可读事件的协程数
+	proxyMode    proxyproto.Mode
+	limiter      *sun.Limiter        //连接数与新建连接速率的限制
+	duplicate    sun.DuplicatePolicy //同一个channelId重复登录时的策略
+	pushWorkers  int                 //Broadcast与PushMany同时推送的协程数
 }
 
-// Server is a websocket implement of the Server
+// ServerOption ServerOption
+type ServerOption func(*ServerOptions)
+
+// WithCompression 客户端在握手帧中声明了FlagCompressAccept时，压缩下行消息。
+// level为compress/flate的压缩级别，超过threshold的消息才会被压缩。
+// 两者为0时使用默认值，见NoCompression与CompressAll
+func WithCompression(level, threshold int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.compress = true
+		opts.compressLvl = level
+		opts.compressMin = threshold
+	}
+}
+
+// WithTLSConfig 使用TLS监听，如果需要校验客户端证书(mTLS)，
+// 设置config.ClientAuth为tls.RequireAndVerifyClientCert，
+// Acceptor中可以通过PeerCertificate获取已验证的客户端证书
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.tlsConfig = config
+	}
+}
+
+// WithProxyProtocol 在Acceptor执行之前解析PROXY protocol v1/v2头部，
+// Conn.RemoteAddr()返回客户端的真实地址，只能在可信的负载均衡之后开启
+func WithProxyProtocol(mode proxyproto.Mode) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.proxyMode = mode
+	}
+}
+
+// WithLoginWait 设置握手阶段的超时，从Accept连接开始计算，PROXY protocol头部、TLS握手与Acceptor.Accept
+// 共用这一个期限，都需要在wait之内完成，
+// Accept超时的连接会收到一个原因为"login timeout"的OpClose帧
+func WithLoginWait(wait time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		if wait > 0 {
+			opts.loginwait = wait
+		}
+	}
+}
+
+// WithDuplicatePolicy 设置同一个channelId重复登录时的策略，默认拒绝新的连接
+func WithDuplicatePolicy(policy sun.DuplicatePolicy) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.duplicate = policy
+	}
+}
+
+// WithLimiter 限制连接总数、握手中的连接数与每个IP新建连接的速率，
+// 被拒绝的连接会收到一个带有原因的OpClose帧，并计入limiter.Stats()
+func WithLimiter(limiter *sun.Limiter) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.limiter = limiter
+	}
+}
+
+// WithPushConcurrency 设置Broadcast与PushMany同时推送的协程数，默认为sun.DefaultPushConcurrency，
+// 推送不会等待发送队列已满的慢连接，它们在PushReport中记为sun.ErrWriteQueueFull
+func WithPushConcurrency(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.pushWorkers = n
+	}
+}
+
+// WithNetpoll 使用epoll驱动读取(仅支持linux)，连接可读时由workers个协程非阻塞地读取已经到达的数据，
+// 不完整的帧需要在loginwait之内接收完整，写协程只在有消息时启动，空闲的连接不再占用协程。
+// workers为0时使用runtime.NumCPU()。
+// 不支持与WithTLSConfig或者proxyproto.ModeOptional同时使用
+func WithNetpoll(workers int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.netpoll = true
+		opts.pollWorkers = workers
+	}
+}
+
+// WithWriteBufferSize 设置连接写缓冲区大小
+func WithWriteBufferSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.writeBuffer = size
+	}
+}
+
+// WithMaxFrameSize 设置单个帧payload的最大长度，超过时关闭连接
+func WithMaxFrameSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxFrameSize = size
+	}
+}
+
+// Server is a tcp implement of the Server，
+// listen为unix://开头的地址时监听unix domain socket
 type Server struct {
 	listen string
 	naming.ServiceRegistration
@@ -33,20 +139,32 @@ type Server struct {
 	once    sync.Once
 	options ServerOptions
 	quit    *sun.Event
+	poller  *poller
+	lock    sync.Mutex     // 保护lst，保证Shutdown之后不再增加wg
+	lst     net.Listener   // Shutdown时关闭
+	wg      sync.WaitGroup // 连接协程，Shutdown等待它们执行完Disconnect
+	// replaced DuplicateAllow时被替换、仍然在线的连接
+	replaced sun.ReplacedChannels
 }
 
 // NewServer NewServer
-func NewServer(listen string, service naming.ServiceRegistration) sun.Server {
+func NewServer(listen string, service naming.ServiceRegistration, options ...ServerOption) sun.Server {
+	opts := ServerOptions{
+		loginwait:    sun.DefaultLoginWait,
+		readwait:     sun.DefaultReadWait,
+		writewait:    time.Second * 10,
+		maxFrameSize: sun.DefaultMaxFrameSize,
+		writeBuffer:  sun.DefaultWriteBufferSize,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
 	return &Server{
 		listen:              listen,
 		ServiceRegistration: service,
 		ChannelMap:          sun.NewChannels(100),
 		quit:                sun.NewEvent(),
-		options: ServerOptions{
-			loginwait: sun.DefaultLoginWait,
-			readwait:  sun.DefaultReadWait,
-			writewait: time.Second * 10,
-		},
+		options:             opts,
 	}
 }
 
@@ -65,96 +183,301 @@ func (s *Server) Start() error {
 		s.Acceptor = new(defaultAcceptor)
 	}
 
-	lst, err := net.Listen("tcp", s.listen)
+	if s.options.netpoll {
+		if s.options.tlsConfig != nil {
+			return errors.New("tcp: netpoll does not support tls")
+		}
+		// 没有头部时已经读取的数据缓存在proxyproto.Conn中，netpoll直接读取fd会丢失它们
+		if s.options.proxyMode == proxyproto.ModeOptional {
+			return errors.New("tcp: netpoll does not support optional proxy protocol")
+		}
+		workers := s.options.pollWorkers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		p, err := newPoller(workers, s.MessageListener, s.options.loginwait, s.pollClosed)
+		if err != nil {
+			return err
+		}
+		s.poller = p
+	}
+
+	lst, err := listen(s.listen)
 	if err != nil {
 		return err
 	}
+	// 读取头部的超时由连接协程中的登录期限控制
+	lst = proxyproto.NewListener(lst, s.options.proxyMode, 0)
+	s.lock.Lock()
+	if s.quit.HasFired() {
+		s.lock.Unlock()
+		return lst.Close()
+	}
+	s.lst = lst
+	s.lock.Unlock()
+
 	log.Info("started")
 	for {
 		rawconn, err := lst.Accept()
 		if err != nil {
-			rawconn.Close()
+			// Shutdown关闭了监听
+			if s.quit.HasFired() {
+				return nil
+			}
 			log.Warn(err)
 			continue
 		}
+		if !s.track() {
+			rawconn.Close()
+			return nil
+		}
 		go func(rawconn net.Conn) {
-			conn := NewConn(rawconn)
+			defer s.wg.Done()
+			// PROXY protocol头部、TLS握手与Acceptor.Accept共用一个登录期限
+			deadline := time.Now().Add(s.options.loginwait)
+			limiter := s.options.limiter
+			if err := limiter.BeginHandshake(); err != nil {
+				s.reject(rawconn, err)
+				return
+			}
+			handshaking := true
+			endHandshake := func() {
+				if handshaking {
+					handshaking = false
+					limiter.EndHandshake()
+				}
+			}
+			defer endHandshake()
 
-			id, err := s.Accept(conn, s.options.loginwait)
+			// PROXY protocol头部在TLS握手之前
+			if pc, ok := rawconn.(*proxyproto.Conn); ok {
+				_ = pc.SetReadDeadline(deadline)
+				if err := pc.Handshake(); err != nil {
+					log.Warn("proxy protocol failed - ", err)
+					pc.Close()
+					return
+				}
+			}
+			// 在TLS握手之前检查来源IP，开启PROXY protocol时是客户端的真实地址
+			if err := limiter.Allow(rawconn.RemoteAddr()); err != nil {
+				s.reject(rawconn, err)
+				return
+			}
+			// 在Accept之前完成TLS握手，Acceptor才能拿到已验证的对端证书
+			if s.options.tlsConfig != nil {
+				tlsConn := tls.Server(rawconn, s.options.tlsConfig)
+				rawconn = tlsConn
+				_ = tlsConn.SetDeadline(deadline)
+				if err := tlsConn.Handshake(); err != nil {
+					log.Warn("tls handshake failed - ", err)
+					tlsConn.Close()
+					return
+				}
+				_ = tlsConn.SetDeadline(time.Time{})
+			}
+			conn := NewConnWithOptions(rawconn, ConnOptions{
+				MaxFrameSize:      s.options.maxFrameSize,
+				WriteBufferSize:   s.options.writeBuffer,
+				Compress:          s.options.compress,
+				CompressLevel:     s.options.compressLvl,
+				CompressThreshold: s.options.compressMin,
+				PooledWriteBuffer: s.options.netpoll,
+			})
+
+			session, err := sun.AcceptWithin(s.Acceptor, conn, time.Until(deadline))
+			endHandshake()
 			if err != nil {
 				_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+				_ = conn.Flush()
 				conn.Close()
 				return
 			}
-			if _, ok := s.Get(id); ok {
-				log.Warnf("channel %s existed", id)
-				_ = conn.WriteFrame(sun.OpClose, []byte("channelId is repeated"))
+			if err = limiter.AddChannel(); err != nil {
+				log.Warnf("channel %s rejected - %v", session.ChannelID, err)
+				_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+				_ = conn.Flush()
 				conn.Close()
 				return
 			}
 
-			channel := sun.NewChannel(id, conn)
+			if s.poller != nil {
+				s.servePoll(session, rawconn, conn)
+				return
+			}
+			channel := sun.NewChannel(session.ChannelID, conn)
+			channel.SetSession(session)
 			channel.SetReadWait(s.options.readwait)
 			channel.SetWriteWait(s.options.writewait)
+			if !s.login(channel) {
+				return
+			}
 
-			s.Add(channel)
-
-			log.Info("accept ", channel)
+			log.Info("accept ", channel.ID())
 			err = channel.Readloop(s.MessageListener)
 			if err != nil {
 				log.Info(err)
 			}
-			s.Remove(channel.ID())
-			_ = s.Disconnect(channel.ID())
-			channel.Close()
+			s.logout(channel)
 		}(rawconn)
+	}
+}
 
-		select {
-		case <-s.quit.Done():
-			return fmt.Errorf("listen exited")
-		default:
-		}
+// reject 拒绝一个还没有完成握手的连接，TLS握手之前无法发送OpClose帧，直接关闭。
+// 开启PROXY protocol时RemoteAddr()会阻塞读取头部，因此日志中只记录监听地址
+func (s *Server) reject(rawconn net.Conn, err error) {
+	logger.WithFields(logger.Fields{
+		"module": "tcp.server",
+		"listen": s.listen,
+		"id":     s.ServiceID(),
+	}).Debugf("reject - %v", err)
+	if s.options.tlsConfig == nil {
+		_ = rawconn.SetWriteDeadline(time.Now().Add(s.options.writewait))
+		_ = WriteFrame(rawconn, sun.OpClose, []byte(err.Error()))
 	}
+	rawconn.Close()
+}
 
+// track 记录一个新的连接协程，Shutdown之后返回false
+func (s *Server) track() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.quit.HasFired() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
 }
 
-// Shutdown Shutdown
+// servePoll 把握手完成的连接交给poller，当前协程随后退出
+func (s *Server) servePoll(session *sun.Session, rawconn net.Conn, conn *TcpConn) {
+	channel := sun.NewPollChannel(session.ChannelID, conn)
+	channel.SetSession(session)
+	channel.SetReadWait(s.options.readwait)
+	channel.SetWriteWait(s.options.writewait)
+	if !s.login(channel) {
+		return
+	}
+	if err := s.poller.add(rawconn, conn, channel); err != nil {
+		s.pollClosed(channel, err)
+	}
+}
+
+// login 按照重复登录策略把channel加入ChannelMap，被拒绝时关闭channel并返回false
+func (s *Server) login(channel sun.Channel) bool {
+	log := logger.WithFields(logger.Fields{
+		"module": "tcp.server",
+		"id":     s.ServiceID(),
+	})
+	old, err := sun.AddWithPolicy(s.ChannelMap, channel, s.options.duplicate, &s.replaced)
+	if err != nil {
+		log.Warnf("channel %s rejected - %v", channel.ID(), err)
+		_ = channel.WriteFrame(sun.OpClose, []byte(err.Error()))
+		channel.Close()
+		s.options.limiter.RemoveChannel()
+		return false
+	}
+	if old != nil {
+		log.Infof("channel %s kicked by a new login", old.ID())
+		_ = s.Disconnect(old.Session())
+	}
+	return true
+}
+
+// logout 连接关闭之后的清理，被踢掉的连接不会再次回调Disconnect
+func (s *Server) logout(channel sun.Channel) {
+	s.options.limiter.RemoveChannel()
+	if s.replaced.Logout(s.ChannelMap, channel) {
+		_ = s.Disconnect(channel.Session())
+	}
+	channel.Close()
+}
+
+// pollClosed netpoll模式下连接读取失败或者超时之后的清理
+func (s *Server) pollClosed(channel *sun.PollChannel, err error) {
+	logger.WithFields(logger.Fields{
+		"module": "tcp.server",
+		"id":     s.ServiceID(),
+	}).Info(err)
+	s.logout(channel)
+}
+
+// Shutdown 停止监听，通知所有连接服务下线，并在ctx到期之前写完队列中的消息，
+// 返回时每个Channel都已经回调了StateListener.Disconnect，Start返回nil
 func (s *Server) Shutdown(ctx context.Context) error {
 	log := logger.WithFields(logger.Fields{
 		"module": "tcp.server",
 		"id":     s.ServiceID(),
 	})
+	var err error
 	s.once.Do(func() {
 		defer func() {
 			log.Infoln("shutdown")
 		}()
-		// close channels
-		chanels := s.ChannelMap.All()
-		for _, ch := range chanels {
-			ch.Close()
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
-			}
+		// 不再接收新的连接
+		s.lock.Lock()
+		s.quit.Fire()
+		if s.lst != nil {
+			_ = s.lst.Close()
 		}
+		s.lock.Unlock()
 
+		sun.ShutdownChannels(ctx, s.ChannelMap, sun.CloseReasonShutdown)
+		s.replaced.Shutdown(ctx, sun.CloseReasonShutdown)
+		// netpoll模式下连接没有常驻协程，由poller回调Disconnect
+		if s.poller != nil {
+			s.poller.closeAll()
+			s.poller.stop()
+		}
+		// 等待连接协程执行完Disconnect
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
 	})
-	return nil
+	return err
 }
 
-// string channelID
+// Push string channelID
 // []byte data
 func (s *Server) Push(id string, data []byte) error {
 	ch, ok := s.ChannelMap.Get(id)
 	if !ok {
-		return errors.New("channel no found")
+		return sun.ErrChannelNotFound
 	}
 	return ch.Push(data)
 }
 
+// Redirect 通知连接迁移到其它节点
+func (s *Server) Redirect(targets []string, window time.Duration, ids ...string) (int, error) {
+	return sun.RedirectChannels(s.ChannelMap, targets, window, ids...)
+}
+
+// PushToUser 推送消息到用户所有满足filters的在线设备
+func (s *Server) PushToUser(userID string, payload []byte, filters ...sun.DeviceFilter) (int, error) {
+	return sun.PushToUser(s.ChannelMap, userID, payload, filters...)
+}
+
+// Kick 踢掉用户所有满足filters的在线设备
+func (s *Server) Kick(userID string, reason string, filters ...sun.DeviceFilter) int {
+	return sun.KickUser(s.ChannelMap, userID, reason, filters...)
+}
+
+// Broadcast 推送消息到所有满足filters的连接
+func (s *Server) Broadcast(payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.BroadcastChannels(s.ChannelMap, payload, s.options.pushWorkers, filters...)
+}
+
+// PushMany 推送消息到ids中满足filters的连接
+func (s *Server) PushMany(ids []string, payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.PushChannels(s.ChannelMap, ids, payload, s.options.pushWorkers, filters...)
+}
+
 // SetAcceptor SetAcceptor
 func (s *Server) SetAcceptor(acceptor sun.Acceptor) {
 	s.Acceptor = acceptor
@@ -184,6 +507,6 @@ type defaultAcceptor struct {
 }
 
 // Accept defaultAcceptor
-func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (string, error) {
-	return ksuid.New().String(), nil
+func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: ksuid.New().String()}, nil
 }
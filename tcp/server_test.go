@@ -0,0 +1,618 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+)
+
+type pollListener struct {
+	echoListener
+	disconnected chan string
+}
+
+func (l *pollListener) Disconnect(session *sun.Session) error {
+	l.disconnected <- session.ChannelID
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("goroutine", func(t *testing.T) {
+		testShutdown(t)
+	})
+	if runtime.GOOS == "linux" {
+		t.Run("netpoll", func(t *testing.T) {
+			testShutdown(t, WithNetpoll(1))
+		})
+	}
+}
+
+func testShutdown(t *testing.T, options ...ServerOption) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, options...)
+	lst := &pollListener{disconnected: make(chan string, 1)}
+	srv.SetAcceptor(&addrAcceptor{})
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn.Close()
+	id := rawconn.LocalAddr().String()
+	for i := 0; i < 50; i++ {
+		if _, ok := srv.(*Server).Get(id); ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Shutdown之前推送的消息都要送达
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := srv.Push(id, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewConn(rawconn)
+	_ = rawconn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < count; i++ {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(frame.GetPayload()); got != fmt.Sprint(i) {
+			t.Fatalf("got %q, want %d", got, i)
+		}
+	}
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetOpCode() != sun.OpClose || string(frame.GetPayload()) != sun.CloseReasonShutdown {
+		t.Fatalf("unexpected frame %d %q", frame.GetOpCode(), frame.GetPayload())
+	}
+
+	select {
+	case got := <-lst.disconnected:
+		if got != id {
+			t.Fatalf("disconnected %s, want %s", got, id)
+		}
+	default:
+		t.Fatal("Disconnect is not called before Shutdown returns")
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start does not return after Shutdown")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener should be closed after Shutdown")
+	}
+}
+
+type notifyAcceptor struct {
+	accepted chan string
+}
+
+func (a *notifyAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	id := conn.RemoteAddr().String()
+	a.accepted <- id
+	return &sun.Session{ChannelID: id}, nil
+}
+
+func TestRedirect(t *testing.T) {
+	start := func(id string) (sun.Server, string, *notifyAcceptor, *pollListener) {
+		addr := freeAddr(t)
+		srv := NewServer(addr, &naming.DefaultService{Id: id})
+		acceptor := &notifyAcceptor{accepted: make(chan string, 1)}
+		lst := &pollListener{disconnected: make(chan string, 1)}
+		srv.SetAcceptor(acceptor)
+		srv.SetMessageListener(lst)
+		srv.SetStateListener(lst)
+		go func() {
+			_ = srv.Start()
+		}()
+		t.Cleanup(func() {
+			_ = srv.Shutdown(context.Background())
+		})
+		return srv, addr, acceptor, lst
+	}
+	srv1, addr1, acceptor1, lst1 := start("srv1")
+	srv2, addr2, acceptor2, _ := start("srv2")
+	time.Sleep(time.Millisecond * 100)
+
+	cli := NewClient("c1", "client", ClientOptions{})
+	cli.SetDialer(&tlsDialer{})
+	_, port1, _ := net.SplitHostPort(addr1)
+	if err := cli.Connect("localhost:" + port1); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	id1 := <-acceptor1.accepted
+
+	count, err := srv1.Redirect([]string{addr2}, time.Millisecond*200)
+	if err != nil || count != 1 {
+		t.Fatalf("redirected %d channels, %v", count, err)
+	}
+	// 迁移之前旧连接上的消息照常送达
+	if err = srv1.Push(id1, []byte("from srv1")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		id2 := <-acceptor2.accepted
+		for i := 0; i < 50; i++ {
+			if srv2.Push(id2, []byte("from srv2")) == nil {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+
+	for _, want := range []string{"from srv1", "from srv2"} {
+		frame, err := cli.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(frame.GetPayload()); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	select {
+	case id := <-lst1.disconnected:
+		if id != id1 {
+			t.Fatalf("disconnected %s, want %s", id, id1)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("old connection is not closed after redirect")
+	}
+	if err = cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cli.Read()
+	if err != nil || !strings.HasSuffix(string(frame.GetPayload()), ":hello") {
+		t.Fatalf("unexpected echo %v %v", frame, err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	addr := freeAddr(t)
+	limiter := sun.NewLimiter(sun.Limits{MaxChannels: 1, IPRate: 0.001, IPBurst: 3})
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithLimiter(limiter))
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	dial := func() (net.Conn, sun.Conn) {
+		rawconn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = rawconn.SetReadDeadline(time.Now().Add(time.Second))
+		return rawconn, NewConn(rawconn)
+	}
+	expectClose := func(conn sun.Conn, reason error) {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.GetOpCode() != sun.OpClose || string(frame.GetPayload()) != reason.Error() {
+			t.Fatalf("unexpected frame %d %q", frame.GetOpCode(), frame.GetPayload())
+		}
+	}
+
+	rawconn1, conn1 := dial()
+	defer rawconn1.Close()
+	if err := WriteFrame(conn1, sun.OpBinary, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn1.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	rawconn2, conn2 := dial()
+	defer rawconn2.Close()
+	expectClose(conn2, sun.ErrTooManyChannels)
+
+	// 令牌桶的容量为3，第四个连接被限速
+	rawconn3, conn3 := dial()
+	defer rawconn3.Close()
+	expectClose(conn3, sun.ErrTooManyChannels)
+	rawconn4, conn4 := dial()
+	defer rawconn4.Close()
+	expectClose(conn4, sun.ErrRateLimited)
+
+	stats := limiter.Stats()
+	if stats.Channels != 1 || stats.RejectedChannels != 2 || stats.RejectedRate != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// frameAcceptor 与examples/mock一样读取一个鉴权帧，payload就是channelId
+type frameAcceptor struct{}
+
+func (a *frameAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return &sun.Session{ChannelID: string(frame.GetPayload())}, nil
+}
+
+// replyAcceptor 握手成功之后写一个响应帧，但不调用Flush
+type replyAcceptor struct{ frameAcceptor }
+
+func (a *replyAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	session, err := a.frameAcceptor.Accept(conn, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return session, conn.WriteFrame(sun.OpBinary, []byte("welcome"))
+}
+
+func TestAcceptReplyFlushed(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"})
+	srv.SetAcceptor(&replyAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn.Close()
+	if err = WriteFrame(rawconn, sun.OpBinary, []byte("u1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = rawconn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := NewConn(rawconn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.GetPayload()) != "welcome" {
+		t.Fatalf("unexpected reply %s", frame.GetPayload())
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithLoginWait(time.Millisecond*200))
+	srv.SetAcceptor(&frameAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	// 连接之后不发送鉴权帧
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawconn.Close()
+	_ = rawconn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := NewConn(rawconn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetOpCode() != sun.OpClose || string(frame.GetPayload()) != sun.ErrLoginTimeout.Error() {
+		t.Fatalf("unexpected frame %d %q", frame.GetOpCode(), frame.GetPayload())
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	login := func(t *testing.T, addr string) (net.Conn, sun.Conn) {
+		rawconn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			rawconn.Close()
+		})
+		_ = rawconn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		if err = WriteFrame(rawconn, sun.OpBinary, []byte("u1")); err != nil {
+			t.Fatal(err)
+		}
+		return rawconn, NewConn(rawconn)
+	}
+	start := func(t *testing.T, policy sun.DuplicatePolicy) (*Server, string, *pollListener) {
+		addr := freeAddr(t)
+		srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithDuplicatePolicy(policy)).(*Server)
+		lst := &pollListener{disconnected: make(chan string, 2)}
+		srv.SetAcceptor(&frameAcceptor{})
+		srv.SetMessageListener(lst)
+		srv.SetStateListener(lst)
+		go func() {
+			_ = srv.Start()
+		}()
+		t.Cleanup(func() {
+			_ = srv.Shutdown(context.Background())
+		})
+		time.Sleep(time.Millisecond * 100)
+		return srv, addr, lst
+	}
+	// loggedIn 等待u1对应的Channel被替换
+	loggedIn := func(t *testing.T, srv *Server, prev sun.Channel) sun.Channel {
+		for i := 0; i < 100; i++ {
+			if ch, ok := srv.Get("u1"); ok && ch != prev {
+				return ch
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("u1 does not login")
+		return nil
+	}
+	expectFrame := func(t *testing.T, conn sun.Conn, code sun.OpCode, payload string) {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.GetOpCode() != code || string(frame.GetPayload()) != payload {
+			t.Fatalf("unexpected frame %d %q", frame.GetOpCode(), frame.GetPayload())
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		srv, addr, _ := start(t, sun.DuplicateReject)
+		login(t, addr)
+		loggedIn(t, srv, nil)
+		_, conn2 := login(t, addr)
+		expectFrame(t, conn2, sun.OpClose, sun.ErrChannelRepeated.Error())
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		srv, addr, lst := start(t, sun.DuplicateKickOld)
+		_, conn1 := login(t, addr)
+		ch1 := loggedIn(t, srv, nil)
+		_, conn2 := login(t, addr)
+		expectFrame(t, conn1, sun.OpClose, sun.CloseReasonKicked)
+		if id := <-lst.disconnected; id != "u1" {
+			t.Fatalf("disconnected %s", id)
+		}
+		loggedIn(t, srv, ch1)
+		_ = srv.Push("u1", []byte("hello"))
+		expectFrame(t, conn2, sun.OpBinary, "hello")
+		// 被踢掉的连接退出时不会再次回调Disconnect
+		select {
+		case id := <-lst.disconnected:
+			t.Fatalf("unexpected disconnect %s", id)
+		case <-time.After(time.Millisecond * 200):
+		}
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		srv, addr, _ := start(t, sun.DuplicateAllow)
+		rawconn1, conn1 := login(t, addr)
+		ch1 := loggedIn(t, srv, nil)
+		_, conn2 := login(t, addr)
+		loggedIn(t, srv, ch1)
+		_ = srv.Push("u1", []byte("hello"))
+		expectFrame(t, conn2, sun.OpBinary, "hello")
+		// 旧的连接仍然可以上行消息
+		if err := WriteFrame(rawconn1, sun.OpBinary, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		expectFrame(t, conn1, sun.OpBinary, "u1:hi")
+	})
+
+	t.Run("allow shutdown", func(t *testing.T) {
+		srv, addr, lst := start(t, sun.DuplicateAllow)
+		_, conn1 := login(t, addr)
+		ch1 := loggedIn(t, srv, nil)
+		_, conn2 := login(t, addr)
+		loggedIn(t, srv, ch1)
+
+		// 被替换的连接也会在Shutdown时关闭并回调Disconnect
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		expectFrame(t, conn1, sun.OpClose, sun.CloseReasonShutdown)
+		expectFrame(t, conn2, sun.OpClose, sun.CloseReasonShutdown)
+		for i := 0; i < 2; i++ {
+			select {
+			case <-lst.disconnected:
+			case <-time.After(time.Second):
+				t.Fatal("Disconnect is not called for both channels")
+			}
+		}
+	})
+}
+
+// sessionAcceptor 握手帧的payload是userId，deviceId固定为d1
+type sessionAcceptor struct{}
+
+func (a *sessionAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	userID := string(frame.GetPayload())
+	session := &sun.Session{
+		ChannelID: userID + "_d1",
+		UserID:    userID,
+		DeviceID:  "d1",
+		App:       "im",
+		Version:   "1.0.0",
+	}
+	session.Set("tenant", "t1")
+	return session, nil
+}
+
+type sessionListener struct {
+	received     chan *sun.Session
+	disconnected chan *sun.Session
+}
+
+func (l *sessionListener) Receive(ag sun.Agent, payload []byte) {
+	l.received <- ag.Session()
+}
+
+func (l *sessionListener) Disconnect(session *sun.Session) error {
+	l.disconnected <- session
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"})
+	lst := &sessionListener{received: make(chan *sun.Session, 1), disconnected: make(chan *sun.Session, 1)}
+	srv.SetAcceptor(&sessionAcceptor{})
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	rawconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = WriteFrame(rawconn, sun.OpBinary, []byte("u1"))
+	_ = WriteFrame(rawconn, sun.OpBinary, []byte("hello"))
+
+	var session *sun.Session
+	select {
+	case session = <-lst.received:
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+	if session.ChannelID != "u1_d1" || session.UserID != "u1" || session.DeviceID != "d1" || session.Version != "1.0.0" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if session.RemoteIP != "127.0.0.1" {
+		t.Fatalf("remote ip %q, want 127.0.0.1", session.RemoteIP)
+	}
+	if tenant, _ := session.Get("tenant"); tenant != "t1" {
+		t.Fatalf("tenant %q, want t1", tenant)
+	}
+
+	rawconn.Close()
+	select {
+	case got := <-lst.disconnected:
+		if got != session {
+			t.Fatal("Disconnect should receive the same session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+}
+
+// deviceAcceptor 握手帧的payload是 userId/deviceId/deviceType
+type deviceAcceptor struct{}
+
+func (a *deviceAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(frame.GetPayload()), "/")
+	return &sun.Session{
+		ChannelID:  parts[0] + "_" + parts[1],
+		UserID:     parts[0],
+		DeviceID:   parts[1],
+		DeviceType: parts[2],
+	}, nil
+}
+
+func TestMultiDevice(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"})
+	lst := &sessionListener{received: make(chan *sun.Session, 1), disconnected: make(chan *sun.Session, 2)}
+	srv.SetAcceptor(&deviceAcceptor{})
+	srv.SetMessageListener(lst)
+	srv.SetStateListener(lst)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	login := func(handshake string) sun.Conn {
+		rawconn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			rawconn.Close()
+		})
+		_ = rawconn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		_ = WriteFrame(rawconn, sun.OpBinary, []byte(handshake))
+		return NewConn(rawconn)
+	}
+	phone := login("u1/d1/ios")
+	desktop := login("u1/d2/pc")
+	for i := 0; i < 100 && len(srv.(*Server).ByUser("u1")) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	count, err := srv.PushToUser("u1", []byte("hello"))
+	if err != nil || count != 2 {
+		t.Fatalf("pushed %d, %v", count, err)
+	}
+	_, _ = srv.PushToUser("u1", []byte("ios only"), sun.DeviceTypes("ios"))
+	for _, expect := range []string{"hello", "ios only"} {
+		frame, err := phone.ReadFrame()
+		if err != nil || string(frame.GetPayload()) != expect {
+			t.Fatalf("phone got %v %v, want %q", frame, err, expect)
+		}
+	}
+
+	if n := srv.Kick("u1", "", sun.DeviceIDs("d2")); n != 1 {
+		t.Fatalf("kicked %d, want 1", n)
+	}
+	for _, expect := range []string{"hello", sun.CloseReasonKicked} {
+		frame, err := desktop.ReadFrame()
+		if err != nil || string(frame.GetPayload()) != expect {
+			t.Fatalf("desktop got %v %v, want %q", frame, err, expect)
+		}
+	}
+	select {
+	case session := <-lst.disconnected:
+		if session.DeviceID != "d2" {
+			t.Fatalf("disconnected %s, want d2", session.DeviceID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not called")
+	}
+	if n := len(srv.(*Server).ByUser("u1")); n != 1 {
+		t.Fatalf("u1 has %d devices, want 1", n)
+	}
+}
@@ -0,0 +1,44 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+)
+
+// Dial 拨号，tlsConfig不为nil时建立TLS连接并完成握手，供Dialer实现使用。
+// address为unix://开头时连接unix domain socket
+func Dial(address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	network, addr := ParseAddress(address)
+	if tlsConfig == nil {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, network, addr, tlsConfig)
+}
+
+// ConnectionState 返回TLS连接的状态，非TLS连接返回false
+func (c *TcpConn) ConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// PeerCertificate 返回mTLS中已经通过校验的客户端证书，
+// Acceptor可以用它作为对端的身份，如 cert.Subject.CommonName
+func PeerCertificate(conn sun.Conn) (*x509.Certificate, bool) {
+	tc, ok := conn.(*TcpConn)
+	if !ok {
+		return nil, false
+	}
+	state, ok := tc.ConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return state.VerifiedChains[0][0], true
+}
@@ -0,0 +1,134 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+)
+
+// newCert 生成一个由parent签名的证书，parent为nil时生成自签名的CA
+func newCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func freeAddr(t *testing.T) string {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	return lst.Addr().String()
+}
+
+type certAcceptor struct{}
+
+func (a *certAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	cert, ok := PeerCertificate(conn)
+	if !ok {
+		return nil, errors.New("client certificate is required")
+	}
+	return &sun.Session{ChannelID: cert.Subject.CommonName}, nil
+}
+
+type echoListener struct{}
+
+func (l *echoListener) Receive(ag sun.Agent, payload []byte) {
+	_ = ag.Push([]byte(ag.ID() + ":" + string(payload)))
+}
+
+func (l *echoListener) Disconnect(session *sun.Session) error { return nil }
+
+type tlsDialer struct{}
+
+func (d *tlsDialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
+	return Dial(ctx.Address, ctx.Timeout, ctx.TLSConfig)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	addr := freeAddr(t)
+	srv := NewServer(addr, &naming.DefaultService{Id: "srv1"}, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "server", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+	srv.SetAcceptor(&certAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	cli := NewClient("c1", "client", ClientOptions{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "user1", &ca)},
+		RootCAs:      pool,
+	}})
+	cli.SetDialer(&tlsDialer{})
+	// Connect会用url.Parse校验地址，使用localhost:port
+	_, port, _ := net.SplitHostPort(addr)
+	if err := cli.Connect("localhost:" + port); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.GetPayload()) != "user1:hello" {
+		t.Fatalf("unexpected payload %s", frame.GetPayload())
+	}
+
+	// 没有客户端证书时握手失败
+	plain := NewClient("c2", "client", ClientOptions{TLSConfig: &tls.Config{RootCAs: pool}})
+	plain.SetDialer(&tlsDialer{})
+	if err := plain.Connect("localhost:" + port); err == nil {
+		_, err = plain.Read()
+		if err == nil {
+			t.Fatal("expect an error without client certificate")
+		}
+		plain.Close()
+	}
+}
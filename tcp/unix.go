@@ -0,0 +1,43 @@
+package tcp
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// UnixScheme unix domain socket地址的前缀，如 unix:///var/run/sun.sock，
+// 网关与逻辑服务部署在同一台机器上时可以绕过loopback的tcp协议栈
+const UnixScheme = "unix://"
+
+// ParseAddress 解析监听或拨号的地址，返回net.Listen/net.Dial使用的network与address
+func ParseAddress(address string) (network, addr string) {
+	if strings.HasPrefix(address, UnixScheme) {
+		return "unix", strings.TrimPrefix(address, UnixScheme)
+	}
+	return "tcp", address
+}
+
+// listen 监听tcp或unix地址，上一个进程异常退出遗留的socket文件会被删除
+func listen(address string) (net.Listener, error) {
+	network, addr := ParseAddress(address)
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+	return net.Listen(network, addr)
+}
+
+// removeStaleSocket 只删除没有进程在监听的socket文件
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
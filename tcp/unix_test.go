@@ -0,0 +1,59 @@
+package tcp
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunrnalike/sun/naming"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sun.sock")
+	// 模拟上一个进程遗留的socket文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	service := &naming.DefaultService{Id: "srv1", Protocol: "unix", Address: path}
+	srv := NewServer(service.DialURL(), service)
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	cli := NewClient("c1", "client", ClientOptions{})
+	cli.SetDialer(&tlsDialer{})
+	if err := cli.Connect(service.DialURL()); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(frame.GetPayload()), ":hello") {
+		t.Fatalf("unexpected payload %q", frame.GetPayload())
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	network, addr := ParseAddress("unix:///var/run/sun.sock")
+	if network != "unix" || addr != "/var/run/sun.sock" {
+		t.Fatal(network, addr)
+	}
+	network, addr = ParseAddress("localhost:8000")
+	if network != "tcp" || addr != "localhost:8000" {
+		t.Fatal(network, addr)
+	}
+}
@@ -0,0 +1,100 @@
+package kim
+
+import "errors"
+
+// ErrUserOffline 用户没有符合条件的在线设备
+var ErrUserOffline = errors.New("user offline")
+
+// DeviceFilter 按Session过滤同一个用户的设备，返回true表示选中
+type DeviceFilter func(*Session) bool
+
+// DeviceTypes 只选中Session.DeviceType在types中的设备
+func DeviceTypes(types ...string) DeviceFilter {
+	return func(s *Session) bool {
+		for _, t := range types {
+			if s.DeviceType == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DeviceIDs 只选中Session.DeviceID在ids中的设备，用于踢掉指定的设备
+func DeviceIDs(ids ...string) DeviceFilter {
+	return func(s *Session) bool {
+		for _, id := range ids {
+			if s.DeviceID == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ExceptDevice 排除deviceID，如多端同步时不再推送给发送消息的设备
+func ExceptDevice(deviceID string) DeviceFilter {
+	return func(s *Session) bool {
+		return s.DeviceID != deviceID
+	}
+}
+
+// UserChannels 返回userID在线的设备中满足所有filters的Channel
+func UserChannels(channels ChannelMap, userID string, filters ...DeviceFilter) []Channel {
+	list := channels.ByUser(userID)
+	if len(filters) == 0 {
+		return list
+	}
+	matched := list[:0]
+	for _, ch := range list {
+		if match(ch.Session(), filters) {
+			matched = append(matched, ch)
+		}
+	}
+	return matched
+}
+
+func match(session *Session, filters []DeviceFilter) bool {
+	for _, filter := range filters {
+		if !filter(session) {
+			return false
+		}
+	}
+	return true
+}
+
+// PushToUser 把payload推送到userID所有满足filters的设备，返回成功推送的设备数。
+// 没有满足条件的设备时返回ErrUserOffline，部分设备推送失败时返回第一个错误
+func PushToUser(channels ChannelMap, userID string, payload []byte, filters ...DeviceFilter) (int, error) {
+	list := UserChannels(channels, userID, filters...)
+	if len(list) == 0 {
+		return 0, ErrUserOffline
+	}
+	var count int
+	var first error
+	for _, ch := range list {
+		if err := ch.Push(payload); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		count++
+	}
+	return count, first
+}
+
+// KickUser 踢掉userID所有满足filters的设备：发送原因为reason的OpClose帧之后关闭连接，
+// reason为空时使用CloseReasonKicked，返回踢掉的设备数。
+// 连接关闭之后由Server按正常的断开流程回调StateListener.Disconnect
+func KickUser(channels ChannelMap, userID string, reason string, filters ...DeviceFilter) int {
+	if reason == "" {
+		reason = CloseReasonKicked
+	}
+	list := UserChannels(channels, userID, filters...)
+	for _, ch := range list {
+		_ = ch.WriteFrame(OpClose, []byte(reason))
+		_ = ch.Close()
+	}
+	return len(list)
+}
@@ -0,0 +1,124 @@
+package kim
+
+import (
+	"sync"
+	"testing"
+)
+
+// deviceChannel 带Session的测试Channel，记录WriteFrame与Close
+type deviceChannel struct {
+	Channel
+	mu      sync.Mutex
+	session *Session
+	pushed  [][]byte
+	closed  string
+}
+
+func newDevice(id, uid, deviceID, deviceType string) *deviceChannel {
+	return &deviceChannel{session: &Session{ChannelID: id, UserID: uid, DeviceID: deviceID, DeviceType: deviceType}}
+}
+
+func (c *deviceChannel) ID() string { return c.session.ChannelID }
+
+func (c *deviceChannel) Session() *Session { return c.session }
+
+func (c *deviceChannel) Push(payload []byte) error {
+	c.mu.Lock()
+	c.pushed = append(c.pushed, payload)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *deviceChannel) TryPush(frame *PreparedFrame) error {
+	return c.Push(frame.Payload())
+}
+
+func (c *deviceChannel) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pushed)
+}
+
+func (c *deviceChannel) WriteFrame(code OpCode, payload []byte) error {
+	if code == OpClose {
+		c.closed = string(payload)
+	}
+	return nil
+}
+
+func (c *deviceChannel) Close() error { return nil }
+
+func TestChannelsByUser(t *testing.T) {
+	channels := NewChannels(10)
+	phone := newDevice("c1", "u1", "d1", "ios")
+	desktop := newDevice("c2", "u1", "d2", "pc")
+	channels.Add(phone)
+	channels.Add(desktop)
+	channels.Add(newDevice("c3", "u2", "d3", "ios"))
+	channels.Add(newDevice("c4", "", "", ""))
+
+	if n := len(channels.ByUser("u1")); n != 2 {
+		t.Fatalf("u1 has %d channels, want 2", n)
+	}
+	// 同一个channelId替换之后索引指向新的连接
+	phone2 := newDevice("c1", "u1", "d1", "ios")
+	channels.Swap(phone2)
+	if channels.CompareAndRemove(phone) {
+		t.Fatal("phone is replaced")
+	}
+	for _, ch := range channels.ByUser("u1") {
+		if ch == phone {
+			t.Fatal("index should point to phone2")
+		}
+	}
+	channels.Remove("c2")
+	channels.CompareAndRemove(phone2)
+	if n := len(channels.ByUser("u1")); n != 0 {
+		t.Fatalf("u1 has %d channels, want 0", n)
+	}
+}
+
+func TestPushToUser(t *testing.T) {
+	channels := NewChannels(10)
+	phone := newDevice("c1", "u1", "d1", "ios")
+	desktop := newDevice("c2", "u1", "d2", "pc")
+	channels.Add(phone)
+	channels.Add(desktop)
+
+	count, err := PushToUser(channels, "u1", []byte("hello"))
+	if err != nil || count != 2 {
+		t.Fatalf("pushed %d, %v", count, err)
+	}
+	count, _ = PushToUser(channels, "u1", []byte("ios"), DeviceTypes("ios", "android"))
+	if count != 1 || len(phone.pushed) != 2 || len(desktop.pushed) != 1 {
+		t.Fatal("only the phone should receive the message")
+	}
+	count, _ = PushToUser(channels, "u1", []byte("sync"), ExceptDevice("d2"))
+	if count != 1 || len(desktop.pushed) != 1 {
+		t.Fatal("the sender device should be excluded")
+	}
+	if _, err = PushToUser(channels, "u2", []byte("hello")); err != ErrUserOffline {
+		t.Fatalf("got %v, want ErrUserOffline", err)
+	}
+	if _, err = PushToUser(channels, "u1", []byte("hello"), DeviceTypes("web")); err != ErrUserOffline {
+		t.Fatalf("got %v, want ErrUserOffline", err)
+	}
+}
+
+func TestKickUser(t *testing.T) {
+	channels := NewChannels(10)
+	phone := newDevice("c1", "u1", "d1", "ios")
+	desktop := newDevice("c2", "u1", "d2", "pc")
+	channels.Add(phone)
+	channels.Add(desktop)
+
+	if n := KickUser(channels, "u1", "", DeviceIDs("d2")); n != 1 {
+		t.Fatalf("kicked %d, want 1", n)
+	}
+	if desktop.closed != CloseReasonKicked || phone.closed != "" {
+		t.Fatal("only the desktop should be kicked")
+	}
+	if n := KickUser(channels, "u1", "logout"); n != 2 || phone.closed != "logout" {
+		t.Fatal("all devices should be kicked")
+	}
+}
@@ -1,8 +1,11 @@
 package websocket
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	sun "github.com/sunrnalike/sun"
 	"net"
 	"net/url"
@@ -13,13 +16,24 @@ import (
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/sunrnalike/sun/logger"
+	"github.com/sunrnalike/sun/wire/pkt"
 )
 
 // ClientOptions ClientOptions
 type ClientOptions struct {
-	Heartbeat time.Duration //登陆超时
-	ReadWait  time.Duration //读超时
-	WriteWait time.Duration //写超时
+	Heartbeat      time.Duration //登陆超时
+	ReadWait       time.Duration //读超时
+	WriteWait      time.Duration //写超时
+	MaxFrameSize   int           //单个帧payload的最大长度
+	MaxMessageSize int           //分片重组之后消息的最大长度
+	FragmentSize   int           //大于0时，超过该长度的消息会被拆分成多个分片发送
+	// 以下配置只在Dialer使用Dial协商了permessage-deflate时生效
+	CompressLevel     int //compress/flate的压缩级别
+	CompressThreshold int //超过该长度的消息才会被压缩
+	// TLSConfig 通过DialerContext传给Dialer，用于wss地址
+	TLSConfig *tls.Config
+	// RedirectWindow 迁移通知中没有指定时间窗口时，在这个时间窗口之内随机延迟之后重连
+	RedirectWindow time.Duration
 }
 
 // Client is a websocket implement of the terminal
@@ -33,6 +47,11 @@ type Client struct {
 	state   int32
 	options ClientOptions
 	dc      *sun.DialerContext
+	asm     *assembler
+	mw      *messageWriter
+	// 收到迁移通知之后，在redirectAt重连到target
+	target     string
+	redirectAt time.Time
 }
 
 // NewClient NewClient
@@ -43,6 +62,12 @@ func NewClient(id, name string, opts ClientOptions) sun.Client {
 	if opts.ReadWait == 0 {
 		opts.ReadWait = sun.DefaultReadWait
 	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = sun.DefaultMaxFrameSize
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = sun.DefaultMaxFrameSize
+	}
 
 	cli := &Client{
 		id:      id,
@@ -72,20 +97,46 @@ func (c *Client) Connect(addr string) error {
 		return fmt.Errorf("client has connected")
 	}
 	// step 1 拨号及握手
-	conn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
-		Id:      c.id,
-		Name:    c.name,
-		Address: addr,
-		Timeout: sun.DefaultLoginWait,
-	})
+	conn, err := c.dial(addr)
 	if err != nil {
 		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 		return err
 	}
+	c.use(conn)
+	return nil
+}
+
+func (c *Client) dial(addr string) (net.Conn, error) {
+	conn, err := c.Dialer.DialAndHandshake(sun.DialerContext{
+		Id:        c.id,
+		Name:      c.name,
+		Address:   addr,
+		Timeout:   sun.DefaultLoginWait,
+		TLSConfig: c.options.TLSConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
 	if conn == nil {
-		return fmt.Errorf("conn is nil")
+		return nil, fmt.Errorf("conn is nil")
 	}
+	return conn, nil
+}
+
+// use 切换到一个新的连接，并为它启动心跳，返回旧的连接
+func (c *Client) use(conn net.Conn) net.Conn {
+	asm := newAssembler(c.options.MaxFrameSize, c.options.MaxMessageSize)
+	mw := &messageWriter{fragmentSize: c.options.FragmentSize, mask: true}
+	if _, ok := conn.(*deflateConn); ok {
+		asm.deflate = newDeflate(c.options.CompressLevel, c.options.CompressThreshold)
+		mw.deflate = asm.deflate
+	}
+	c.Lock()
+	old := c.conn
 	c.conn = conn
+	c.asm = asm
+	c.mw = mw
+	c.Unlock()
 
 	if c.options.Heartbeat > 0 {
 		go func() {
@@ -95,7 +146,7 @@ func (c *Client) Connect(addr string) error {
 			}
 		}()
 	}
-	return nil
+	return old
 }
 
 // SetDialer 设置握手逻辑
@@ -115,40 +166,131 @@ func (c *Client) Send(payload []byte) error {
 		return err
 	}
 	// 客户端消息需要使用MASK
-	return wsutil.WriteClientMessage(c.conn, ws.OpBinary, payload)
+	return c.mw.write(c.conn, ws.OpBinary, payload)
+}
+
+// SendPkt 序列化消息包并发送
+func (c *Client) SendPkt(p pkt.Packet) error {
+	return c.Send(pkt.Marshal(p))
 }
 
 // Close 关闭
 func (c *Client) Close() {
 	c.once.Do(func() {
-		if c.conn == nil {
+		c.Lock()
+		conn := c.conn
+		if conn != nil {
+			// graceful close connection
+			c.sendClose(conn)
+		}
+		c.Unlock()
+		if conn == nil {
 			return
 		}
-		// graceful close connection
-		_ = wsutil.WriteClientMessage(c.conn, ws.OpClose, nil)
-
-		c.conn.Close()
+		conn.Close()
 		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 	})
 }
 
+// Read 读取一个帧，迁移通知会被Read处理而不会返回给调用方：
+// 在随机延迟之前照常读取旧连接上的消息，之后重连到新的节点并关闭旧的连接
 func (c *Client) Read() (sun.Frame, error) {
 	if c.conn == nil {
 		return nil, errors.New("connection is nil")
 	}
+	for {
+		frame, err := c.readFrame()
+		if c.target != "" && (err != nil || frame.Header.OpCode == ws.OpClose) {
+			// 旧连接超时或者被服务端关闭
+			if err = c.migrate(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			return nil, errors.New("remote side close the channel")
+		}
+		if frame.Header.OpCode == ws.OpBinary {
+			if r, ok := pkt.ReadRedirect(frame.Payload); ok {
+				c.redirect(r)
+				continue
+			}
+		}
+		return &Frame{
+			raw: frame,
+		}, nil
+	}
+}
+
+func (c *Client) readFrame() (ws.Frame, error) {
+	c.Lock()
+	conn, asm := c.conn, c.asm
+	c.Unlock()
+	var deadline time.Time
 	if c.options.Heartbeat > 0 {
-		_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+		deadline = time.Now().Add(c.options.ReadWait)
+	}
+	if c.target != "" && (deadline.IsZero() || c.redirectAt.Before(deadline)) {
+		deadline = c.redirectAt
+	}
+	if !deadline.IsZero() {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	return asm.next(conn)
+}
+
+// redirect 在时间窗口之内随机选择一个重连的时间点
+func (c *Client) redirect(r *pkt.Redirect) {
+	window := r.Window
+	if window <= 0 {
+		window = c.options.RedirectWindow
 	}
-	frame, err := ws.ReadFrame(c.conn)
+	var delay time.Duration
+	if window > 0 {
+		delay = time.Duration(rand.Int63n(int64(window)))
+	}
+	logger.Infof("%s redirect to %s after %v", c.id, r.Address, delay)
+	c.target = r.Address
+	c.redirectAt = time.Now().Add(delay)
+}
+
+// migrate 等到redirectAt之后连接到新的节点，替换并关闭旧的连接
+func (c *Client) migrate() error {
+	time.Sleep(time.Until(c.redirectAt))
+	target := c.target
+	c.target = ""
+	conn, err := c.dial(target)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if frame.Header.OpCode == ws.OpClose {
-		return nil, errors.New("remote side close the channel")
+	old := c.use(conn)
+	c.Lock()
+	c.sendClose(old)
+	c.Unlock()
+	return old.Close()
+}
+
+// sendClose 发送OpClose，需要持有锁，避免与Send、ping的写入交错
+func (c *Client) sendClose(conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	_ = wsutil.WriteClientMessage(conn, ws.OpClose, nil)
+}
+
+// ReadPkt 读取并解码一个消息包，控制帧会被跳过
+func (c *Client) ReadPkt() (interface{}, error) {
+	for {
+		frame, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if frame.GetOpCode() != sun.OpBinary {
+			continue
+		}
+		return pkt.Read(bytes.NewReader(frame.GetPayload()))
 	}
-	return &Frame{
-		raw: frame,
-	}, nil
 }
 
 func (c *Client) heartbealoop(conn net.Conn) error {
@@ -1,8 +1,13 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	sun "github.com/sunrnalike/sun"
+	"io"
 	"net"
+	"net/http"
 
 	"github.com/gobwas/ws"
 )
@@ -31,29 +36,137 @@ func (f *Frame) GetPayload() []byte {
 	return f.raw.Payload
 }
 
+// ConnOptions ConnOptions
+type ConnOptions struct {
+	MaxFrameSize    int // 单个帧payload的最大长度，超过时ReadFrame返回sun.ErrFrameTooLarge
+	MaxMessageSize  int // 分片重组之后消息的最大长度
+	FragmentSize    int // 大于0时，超过该长度的消息会被拆分成多个分片发送
+	WriteBufferSize int // 写缓冲区大小
+	// Compress 表示双方已经协商了permessage-deflate扩展
+	Compress          bool
+	CompressLevel     int // compress/flate的压缩级别，0为DefaultCompressLevel，不压缩时使用NoCompression
+	CompressThreshold int // 超过该长度的消息才会被压缩，0为DefaultCompressThreshold，小于0时全部压缩
+}
+
 type WsConn struct {
 	net.Conn
+	options  ConnOptions
+	bw       *bufio.Writer
+	asm      *assembler
+	mw       *messageWriter
+	req      *http.Request // 升级时的http请求
+	protocol string        // 协商的子协议
 }
 
 func NewConn(conn net.Conn) *WsConn {
-	return &WsConn{
-		Conn: conn,
+	return NewConnWithOptions(conn, ConnOptions{})
+}
+
+// NewConnWithOptions NewConnWithOptions
+func NewConnWithOptions(conn net.Conn, opts ConnOptions) *WsConn {
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = sun.DefaultMaxFrameSize
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = sun.DefaultMaxFrameSize
+	}
+	if opts.WriteBufferSize <= 0 {
+		opts.WriteBufferSize = sun.DefaultWriteBufferSize
+	}
+	wc := &WsConn{
+		Conn:    conn,
+		options: opts,
+		bw:      bufio.NewWriterSize(conn, opts.WriteBufferSize),
+		asm:     newAssembler(opts.MaxFrameSize, opts.MaxMessageSize),
+		mw:      &messageWriter{fragmentSize: opts.FragmentSize},
+	}
+	if opts.Compress {
+		wc.asm.deflate = newDeflate(opts.CompressLevel, opts.CompressThreshold)
+		wc.mw.deflate = wc.asm.deflate
+	}
+	return wc
+}
+
+// Request 返回升级时的http请求，Acceptor可以从header、query或cookie中读取token，
+// 不需要再读取一个鉴权帧
+func Request(conn sun.Conn) (*http.Request, bool) {
+	c, ok := conn.(*WsConn)
+	if !ok || c.req == nil {
+		return nil, false
+	}
+	return c.req, true
+}
+
+// Subprotocol 返回升级时协商的子协议，没有协商时为空
+func Subprotocol(conn sun.Conn) string {
+	c, ok := conn.(*WsConn)
+	if !ok {
+		return ""
 	}
+	return c.protocol
 }
 
+// ReadFrame 读取一个完整的消息，分片的消息会被重新组装
 func (c *WsConn) ReadFrame() (sun.Frame, error) {
-	f, err := ws.ReadFrame(c.Conn)
+	f, err := c.asm.next(c.Conn)
 	if err != nil {
 		return nil, err
 	}
 	return &Frame{raw: f}, nil
 }
 
+// WriteFrame 把帧写入缓冲区，调用Flush之后才会发送
 func (c *WsConn) WriteFrame(code sun.OpCode, payload []byte) error {
-	f := ws.NewFrame(ws.OpCode(code), true, payload)
-	return ws.WriteFrame(c.Conn, f)
+	return c.mw.write(c.bw, ws.OpCode(code), payload)
 }
 
+// preparedKey 消息的编码结果只与分片大小及压缩参数有关
+type preparedKey struct {
+	fragmentSize int
+	deflate      bool
+	level        int
+	threshold    int
+}
+
+// WritePrepared 写入一个预先编码的消息，分片与压缩参数相同的连接共享同一份编码结果。
+// 客户端发送的帧每次需要不同的mask，不共享编码结果
+func (c *WsConn) WritePrepared(frame *sun.PreparedFrame) error {
+	if c.mw.mask {
+		return c.WriteFrame(sun.OpBinary, frame.Payload())
+	}
+	key := preparedKey{fragmentSize: c.mw.fragmentSize}
+	if d := c.mw.deflate; d != nil {
+		key.deflate, key.level, key.threshold = true, d.level, d.threshold
+	}
+	data, err := frame.Encode(key, func(payload []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		err := c.mw.write(&buf, ws.OpBinary, payload)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.bw.Write(data)
+	return err
+}
+
+// Flush 把缓冲区中的数据一次性写入连接
 func (c *WsConn) Flush() error {
-	return nil
+	return c.bw.Flush()
+}
+
+// readFrame 与ws.ReadFrame相同，但在分配payload之前校验header中的长度
+func readFrame(r io.Reader, maxFrameSize int) (ws.Frame, error) {
+	h, err := ws.ReadHeader(r)
+	if err != nil {
+		return ws.Frame{}, err
+	}
+	if h.Length > int64(maxFrameSize) {
+		return ws.Frame{}, fmt.Errorf("%w: %d exceeds limit %d", sun.ErrFrameTooLarge, h.Length, maxFrameSize)
+	}
+	payload := make([]byte, h.Length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return ws.Frame{}, err
+	}
+	return ws.Frame{Header: h, Payload: payload}, nil
 }
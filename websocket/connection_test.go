@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	sun "github.com/sunrnalike/sun"
+)
+
+func TestReadFrameTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		// 只发送一个声明了超大长度的header
+		_ = ws.WriteHeader(cli, ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 1 << 40})
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{MaxFrameSize: 1024})
+	_, err := conn.ReadFrame()
+	if !errors.Is(err, sun.ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestReadFragmentedMessage(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		_ = ws.WriteFrame(cli, ws.MaskFrame(ws.NewFrame(ws.OpBinary, false, []byte("hel"))))
+		// 控制帧可以穿插在分片之间
+		_ = ws.WriteFrame(cli, ws.MaskFrame(ws.NewFrame(ws.OpPing, true, nil)))
+		_ = ws.WriteFrame(cli, ws.MaskFrame(ws.NewFrame(ws.OpContinuation, false, []byte("lo "))))
+		_ = ws.WriteFrame(cli, ws.MaskFrame(ws.NewFrame(ws.OpContinuation, true, []byte("world"))))
+	}()
+
+	conn := NewConn(srv)
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetOpCode() != sun.OpPing {
+		t.Fatalf("expect a ping frame, got %v", frame.GetOpCode())
+	}
+	frame, err = conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetOpCode() != sun.OpBinary || string(frame.GetPayload()) != "hello world" {
+		t.Fatalf("unexpected message %v %s", frame.GetOpCode(), frame.GetPayload())
+	}
+}
+
+func TestReadFragmentedMessageTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		mw := &messageWriter{fragmentSize: 16, mask: true}
+		_ = mw.write(cli, ws.OpBinary, make([]byte, 64))
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{MaxMessageSize: 32})
+	_, err := conn.ReadFrame()
+	if !errors.Is(err, sun.ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestWriteFragments(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	payload := []byte("a large payload")
+	go func() {
+		conn := NewConnWithOptions(srv, ConnOptions{FragmentSize: 4})
+		_ = conn.WriteFrame(sun.OpBinary, payload)
+		_ = conn.Flush()
+	}()
+
+	frames := 0
+	var recv []byte
+	for {
+		h, err := ws.ReadHeader(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames++
+		body := make([]byte, h.Length)
+		if _, err := io.ReadFull(cli, body); err != nil {
+			t.Fatal(err)
+		}
+		recv = append(recv, body...)
+		if h.Fin {
+			break
+		}
+	}
+	if frames != 4 || string(recv) != string(payload) {
+		t.Fatalf("unexpected fragments %d %s", frames, recv)
+	}
+}
+
+func TestDialBufferedFrame(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	go func() {
+		conn, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		h := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		var buf bytes.Buffer
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		buf.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n")
+		_ = ws.WriteFrame(&buf, ws.NewBinaryFrame([]byte("welcome")))
+		// 握手响应与第一个消息在同一次Write中发送
+		_, _ = conn.Write(buf.Bytes())
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := Dial(context.Background(), "ws://"+lst.Addr().String(), DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := ws.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.Payload) != "welcome" {
+		t.Fatalf("unexpected payload %s", frame.Payload)
+	}
+}
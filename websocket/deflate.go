@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/gobwas/ws/wsflate"
+	sun "github.com/sunrnalike/sun"
+)
+
+// default compression options
+const (
+	DefaultCompressLevel     = flate.BestSpeed
+	DefaultCompressThreshold = 256 // 超过该长度的消息才会被压缩
+)
+
+// CompressLevel与CompressThreshold的零值表示使用默认值，
+// 需要不压缩或者压缩所有消息时使用下面的值
+const (
+	// NoCompression 作为CompressLevel时使用flate.NoCompression
+	NoCompression = -3
+	// CompressAll 作为CompressThreshold时压缩所有的消息，小于0的值都是如此
+	CompressAll = -1
+)
+
+// deflate 实现RFC 7692 permessage-deflate。双方都使用no_context_takeover，
+// 每个消息独立压缩，不需要在连接上保存压缩窗口
+type deflate struct {
+	level     int
+	threshold int
+}
+
+// deflate数据流在Flush之后的固定结尾，发送时需要去掉，接收时补上
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+func newDeflate(level, threshold int) *deflate {
+	switch level {
+	case 0:
+		level = DefaultCompressLevel
+	case NoCompression:
+		level = flate.NoCompression
+	}
+	if threshold == 0 {
+		threshold = DefaultCompressThreshold
+	} else if threshold < 0 {
+		threshold = 0
+	}
+	return &deflate{
+		level:     level,
+		threshold: threshold,
+	}
+}
+
+func (d *deflate) compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, d.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompress 解压消息，解压后的长度不能超过limit，防止压缩炸弹
+func (d *deflate) decompress(payload []byte, limit int) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+	defer fr.Close()
+	// 多读一个字节用来判断是否超过限制
+	buf, err := io.ReadAll(io.LimitReader(fr, int64(limit)+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, fmt.Errorf("%w: decompressed message exceeds limit %d", sun.ErrFrameTooLarge, limit)
+	}
+	return buf, nil
+}
+
+// negotiateDeflate 生成一个服务端的协商器，每个连接都需要一个新的实例
+func negotiateDeflate() *wsflate.Extension {
+	return &wsflate.Extension{
+		Parameters: wsflate.DefaultParameters,
+	}
+}
+
+// deflateConn 是Dial返回的连接，记录了permessage-deflate的协商结果
+type deflateConn struct {
+	net.Conn
+}
@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	sun "github.com/sunrnalike/sun"
+)
+
+func TestCompressedMessage(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	payload := []byte(strings.Repeat("hello kim ", 100))
+	go func() {
+		mw := &messageWriter{fragmentSize: 64, mask: true, deflate: newDeflate(0, 0)}
+		if err := mw.write(cli, ws.OpBinary, payload); err != nil {
+			t.Error(err)
+			cli.Close()
+		}
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{Compress: true})
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.GetPayload()) != string(payload) {
+		t.Fatalf("unexpected payload %s", frame.GetPayload())
+	}
+}
+
+func TestCompressedMessageTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	// 10MiB的0压缩之后只有10KiB左右，解压时超过MaxMessageSize
+	payload := make([]byte, 10<<20)
+	go func() {
+		mw := &messageWriter{mask: true, deflate: newDeflate(0, 0)}
+		_ = mw.write(cli, ws.OpBinary, payload)
+	}()
+
+	conn := NewConnWithOptions(srv, ConnOptions{Compress: true, MaxMessageSize: 1024})
+	if _, err := conn.ReadFrame(); !errors.Is(err, sun.ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestDialNegotiateDeflate(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		accepted := make(chan bool, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var upgrader ws.HTTPUpgrader
+			ext := negotiateDeflate()
+			if accept {
+				upgrader.Negotiate = ext.Negotiate
+			}
+			conn, _, _, err := upgrader.Upgrade(r, w)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, ok := ext.Accepted()
+			accepted <- ok
+			conn.Close()
+		}))
+
+		conn, err := Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http"), DialOptions{Compress: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, isDeflate := conn.(*deflateConn)
+		if ok := <-accepted; ok != accept || isDeflate != accept {
+			t.Fatalf("accept=%v but server accepted=%v client negotiated=%v", accept, ok, isDeflate)
+		}
+		conn.Close()
+		ts.Close()
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		conn := NewConnWithOptions(srv, ConnOptions{Compress: true, CompressThreshold: 100})
+		_ = conn.WriteFrame(sun.OpBinary, []byte("short"))
+		_ = conn.Flush()
+	}()
+
+	h, err := ws.ReadHeader(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1, _, _ := ws.RsvBits(h.Rsv); r1 {
+		t.Fatal("message under threshold should not be compressed")
+	}
+}
+
+func TestCompressAll(t *testing.T) {
+	d := newDeflate(NoCompression, CompressAll)
+	if d.level != flate.NoCompression || d.threshold != 0 {
+		t.Fatalf("unexpected options %d %d", d.level, d.threshold)
+	}
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		conn := NewConnWithOptions(srv, ConnOptions{Compress: true, CompressLevel: NoCompression, CompressThreshold: CompressAll})
+		_ = conn.WriteFrame(sun.OpBinary, []byte("a"))
+		_ = conn.Flush()
+	}()
+	conn := NewConnWithOptions(cli, ConnOptions{Compress: true})
+	frame, err := conn.ReadFrame()
+	if err != nil || string(frame.GetPayload()) != "a" {
+		t.Fatal(frame, err)
+	}
+}
+
+func TestWritePrepared(t *testing.T) {
+	payload := []byte(strings.Repeat("hello kim ", 100))
+	frame := sun.NewPreparedFrame(payload)
+	for i := 0; i < 2; i++ {
+		cli, srv := net.Pipe()
+		go func() {
+			conn := NewConnWithOptions(srv, ConnOptions{Compress: true, FragmentSize: 64})
+			_ = conn.WritePrepared(frame)
+			_ = conn.Flush()
+		}()
+		conn := NewConnWithOptions(cli, ConnOptions{Compress: true})
+		f, err := conn.ReadFrame()
+		cli.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(f.GetPayload()) != string(payload) {
+			t.Fatalf("unexpected payload %s", f.GetPayload())
+		}
+	}
+}
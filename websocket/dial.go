@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+// DialOptions DialOptions
+type DialOptions struct {
+	// Compress 向服务端请求permessage-deflate扩展，
+	// 服务端接受时Client会自动压缩和解压，不支持该扩展的服务端会忽略这个请求
+	Compress bool
+	// TLSConfig 用于wss地址
+	TLSConfig *tls.Config
+	// Header 升级请求中额外的header，如 Authorization
+	Header http.Header
+	// Protocols 请求的子协议，按优先级排列
+	Protocols []string
+}
+
+// Dial 调用ws.Dial拨号，自定义的Dialer可以用它代替ws.Dial
+func Dial(ctx context.Context, address string, opts DialOptions) (net.Conn, error) {
+	dialer := ws.Dialer{
+		TLSConfig: opts.TLSConfig,
+		Protocols: opts.Protocols,
+	}
+	if opts.Header != nil {
+		dialer.Header = ws.HandshakeHeaderHTTP(opts.Header)
+	}
+	if opts.Compress {
+		dialer.Extensions = []httphead.Option{wsflate.DefaultParameters.Option()}
+	}
+	conn, br, hs, err := dialer.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	// 服务端可能在101响应之后立即发送消息，它们已经被读入br
+	if br != nil {
+		conn = &bufferedConn{Conn: conn, br: br}
+	}
+	for _, opt := range hs.Extensions {
+		if bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+			return &deflateConn{Conn: conn}, nil
+		}
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读完握手时缓存在br中的数据，再直接读取连接
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.br == nil {
+		return c.Conn.Read(p)
+	}
+	n, err := c.br.Read(p)
+	if c.br.Buffered() == 0 {
+		ws.PutReader(c.br)
+		c.br = nil
+	}
+	return n, err
+}
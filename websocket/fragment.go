@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	sun "github.com/sunrnalike/sun"
+)
+
+// errors of fragmented messages
+var (
+	ErrUnexpectedContinuation = errors.New("unexpected continuation frame")
+	ErrExpectContinuation     = errors.New("expect a continuation frame")
+)
+
+// assembler 把分片的帧重新组装成一个完整的消息
+type assembler struct {
+	maxFrameSize   int
+	maxMessageSize int
+	deflate        *deflate // 协商了permessage-deflate时不为nil
+	started        bool
+	compressed     bool
+	op             ws.OpCode
+	buf            []byte
+}
+
+func newAssembler(maxFrameSize, maxMessageSize int) *assembler {
+	return &assembler{
+		maxFrameSize:   maxFrameSize,
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// next 读取下一个完整的消息，控制帧可以穿插在分片之间，会被直接返回
+func (a *assembler) next(r io.Reader) (ws.Frame, error) {
+	for {
+		f, err := readFrame(r, a.maxFrameSize)
+		if err != nil {
+			return f, err
+		}
+		if f.Header.OpCode.IsControl() {
+			return f, nil
+		}
+		if f.Header.Masked {
+			ws.Cipher(f.Payload, f.Header.Mask, 0)
+			f.Header.Masked = false
+		}
+
+		if f.Header.OpCode == ws.OpContinuation {
+			if !a.started {
+				return ws.Frame{}, ErrUnexpectedContinuation
+			}
+		} else {
+			if a.started {
+				return ws.Frame{}, ErrExpectContinuation
+			}
+			// 压缩标记只会出现在消息的第一个帧中
+			if a.deflate != nil {
+				if f.Header, a.compressed, err = wsflate.UnsetBit(f.Header); err != nil {
+					return ws.Frame{}, err
+				}
+			}
+			// 没有分片的消息
+			if f.Header.Fin {
+				return a.message(f.Header.OpCode, f.Payload)
+			}
+			a.started = true
+			a.op = f.Header.OpCode
+		}
+
+		if len(a.buf)+len(f.Payload) > a.maxMessageSize {
+			size := len(a.buf) + len(f.Payload)
+			a.reset()
+			return ws.Frame{}, fmt.Errorf("%w: reassembled message %d exceeds limit %d", sun.ErrFrameTooLarge, size, a.maxMessageSize)
+		}
+		a.buf = append(a.buf, f.Payload...)
+		if f.Header.Fin {
+			op, payload := a.op, a.buf
+			a.started = false
+			a.buf = nil
+			return a.message(op, payload)
+		}
+	}
+}
+
+func (a *assembler) message(op ws.OpCode, payload []byte) (ws.Frame, error) {
+	if a.compressed {
+		a.compressed = false
+		var err error
+		if payload, err = a.deflate.decompress(payload, a.maxMessageSize); err != nil {
+			return ws.Frame{}, err
+		}
+	}
+	return ws.NewFrame(op, true, payload), nil
+}
+
+func (a *assembler) reset() {
+	a.started = false
+	a.compressed = false
+	a.buf = nil
+}
+
+// messageWriter 按配置压缩、分片并写出一个消息
+type messageWriter struct {
+	fragmentSize int      // 大于0时把超过它的数据帧拆分成多个分片
+	mask         bool     // 客户端发送的帧需要mask
+	deflate      *deflate // 协商了permessage-deflate时不为nil
+}
+
+func (m *messageWriter) write(w io.Writer, code ws.OpCode, payload []byte) error {
+	compressed := false
+	if m.deflate != nil && code.IsData() && len(payload) >= m.deflate.threshold {
+		p, err := m.deflate.compress(payload)
+		if err != nil {
+			return err
+		}
+		payload, compressed = p, true
+	}
+	if m.fragmentSize <= 0 || len(payload) <= m.fragmentSize || code.IsControl() {
+		return m.writeFrame(w, ws.NewFrame(code, true, payload), compressed)
+	}
+	op := code
+	for len(payload) > 0 {
+		n := m.fragmentSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		if err := m.writeFrame(w, ws.NewFrame(op, n == len(payload), payload[:n]), compressed); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		op = ws.OpContinuation
+		compressed = false
+	}
+	return nil
+}
+
+func (m *messageWriter) writeFrame(w io.Writer, f ws.Frame, compressed bool) error {
+	if compressed {
+		f.Header.Rsv = ws.Rsv(true, false, false)
+	}
+	if m.mask {
+		f = ws.MaskFrame(f)
+	}
+	return ws.WriteFrame(w, f)
+}
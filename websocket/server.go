@@ -2,24 +2,186 @@ package websocket
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	sun "github.com/sunrnalike/sun"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/segmentio/ksuid"
 	"github.com/sunrnalike/sun/logger"
 	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/proxyproto"
 )
 
 // ServerOptions ServerOptions
 type ServerOptions struct {
-	loginwait time.Duration //登陆超时
-	readwait  time.Duration //读超时
-	writewait time.Duration //写超时
+	loginwait    time.Duration //登陆超时
+	readwait     time.Duration //读超时
+	writewait    time.Duration //写超时
+	maxFrameSize int           //单个帧payload的最大长度
+	maxMsgSize   int           //分片重组之后消息的最大长度
+	fragmentSize int           //下行消息的分片大小，0表示不分片
+	writeBuffer  int           //写缓冲区大小
+	compress     bool          //是否接受permessage-deflate扩展
+	compressLvl  int           //压缩级别
+	compressMin  int           //超过该长度的消息才会被压缩
+	path         string        //websocket升级的路径
+	tlsConfig    *tls.Config   //不为nil时使用TLS，即wss
+	handlers     []handler     //同一个端口上额外的http处理器
+	httpConfig   func(*http.Server)
+	proxyMode    proxyproto.Mode
+	authenticate func(*http.Request) error //升级之前校验请求
+	checkOrigin  func(*http.Request) bool  //升级之前校验Origin
+	protocols    []string                  //支持的子协议
+	limiter      *sun.Limiter              //连接数与新建连接速率的限制
+	duplicate    sun.DuplicatePolicy       //同一个channelId重复登录时的策略
+	pushWorkers  int                       //Broadcast与PushMany同时推送的协程数
+}
+
+type handler struct {
+	pattern string
+	handler http.Handler
+}
+
+// ServerOption ServerOption
+type ServerOption func(*ServerOptions)
+
+// WithLoginWait 设置握手阶段的超时，升级请求的头部、PROXY protocol头部与Acceptor.Accept分别需要在wait之内完成，
+// Accept超时的连接会收到一个原因为"login timeout"的OpClose帧
+func WithLoginWait(wait time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		if wait > 0 {
+			opts.loginwait = wait
+		}
+	}
+}
+
+// WithDuplicatePolicy 设置同一个channelId重复登录时的策略，默认拒绝新的连接
+func WithDuplicatePolicy(policy sun.DuplicatePolicy) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.duplicate = policy
+	}
+}
+
+// WithLimiter 限制连接总数、握手中的连接数与每个IP新建连接的速率，被拒绝的请求不会被升级，
+// 速率超限时返回429，其它情况返回503；握手之后超过连接总数的连接会收到一个带有原因的close帧。
+// 被拒绝的连接都会计入limiter.Stats()
+func WithLimiter(limiter *sun.Limiter) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.limiter = limiter
+	}
+}
+
+// WithPushConcurrency 设置Broadcast与PushMany同时推送的协程数，默认为sun.DefaultPushConcurrency，
+// 推送不会等待发送队列已满的慢连接，它们在PushReport中记为sun.ErrWriteQueueFull
+func WithPushConcurrency(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.pushWorkers = n
+	}
+}
+
+// WithMaxMessageSize 设置分片重组之后消息的最大长度
+func WithMaxMessageSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxMsgSize = size
+	}
+}
+
+// WithFragmentSize 下行消息超过size时拆分成多个分片发送
+func WithFragmentSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.fragmentSize = size
+	}
+}
+
+// WithCompression 接受客户端的permessage-deflate扩展请求，
+// level为compress/flate的压缩级别，超过threshold的下行消息才会被压缩。
+// 两者为0时使用默认值，见NoCompression与CompressAll
+func WithCompression(level, threshold int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.compress = true
+		opts.compressLvl = level
+		opts.compressMin = threshold
+	}
+}
+
+// WithPath 设置websocket升级的路径，默认为 /
+func WithPath(path string) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.path = path
+	}
+}
+
+// WithTLSConfig 使用TLS监听，即wss，证书在config.Certificates中设置
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.tlsConfig = config
+	}
+}
+
+// WithHandler 在同一个端口上注册额外的http处理器，如健康检查、监控指标
+func WithHandler(pattern string, h http.Handler) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.handlers = append(opts.handlers, handler{pattern: pattern, handler: h})
+	}
+}
+
+// WithHTTPServer 用于配置底层的http.Server，如ReadHeaderTimeout、IdleTimeout，
+// Addr、Handler与TLSConfig由Server设置
+func WithHTTPServer(config func(*http.Server)) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.httpConfig = config
+	}
+}
+
+// WithProxyProtocol 在升级之前解析PROXY protocol v1/v2头部，
+// Conn.RemoteAddr()与http.Request.RemoteAddr返回客户端的真实地址，只能在可信的负载均衡之后开启
+func WithProxyProtocol(mode proxyproto.Mode) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.proxyMode = mode
+	}
+}
+
+// WithAuthenticator 在升级之前校验http请求中的token，如header、query或cookie，
+// 返回error时响应401，不再升级。通过校验之后，Acceptor可以用Request获取同一个请求
+func WithAuthenticator(authenticate func(r *http.Request) error) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.authenticate = authenticate
+	}
+}
+
+// WithCheckOrigin 在升级之前校验请求的Origin，返回false时响应403
+func WithCheckOrigin(check func(r *http.Request) bool) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.checkOrigin = check
+	}
+}
+
+// WithSubprotocols 设置支持的子协议，选中客户端请求中第一个被支持的子协议，
+// Acceptor中可以用Subprotocol获取协商的结果
+func WithSubprotocols(protocols ...string) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.protocols = protocols
+	}
+}
+
+// WithWriteBufferSize 设置连接写缓冲区大小
+func WithWriteBufferSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.writeBuffer = size
+	}
+}
+
+// WithMaxFrameSize 设置单个帧payload的最大长度，超过时关闭连接
+func WithMaxFrameSize(size int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxFrameSize = size
+	}
 }
 
 // Server is a websocket implement of the Server
@@ -32,18 +194,42 @@ type Server struct {
 	sun.StateListener
 	once    sync.Once
 	options ServerOptions
+	httpsrv *http.Server
+	quit    *sun.Event
+	lock    sync.Mutex     // 保证Shutdown之后不再增加wg
+	wg      sync.WaitGroup // 连接协程，Shutdown等待它们执行完Disconnect
+	// replaced DuplicateAllow时被替换、仍然在线的连接
+	replaced sun.ReplacedChannels
 }
 
 // NewServer NewServer
-func NewServer(listen string, service naming.ServiceRegistration) sun.Server {
+func NewServer(listen string, service naming.ServiceRegistration, options ...ServerOption) sun.Server {
+	opts := ServerOptions{
+		loginwait:    sun.DefaultLoginWait,
+		readwait:     sun.DefaultReadWait,
+		writewait:    time.Second * 10,
+		maxFrameSize: sun.DefaultMaxFrameSize,
+		maxMsgSize:   sun.DefaultMaxFrameSize,
+		writeBuffer:  sun.DefaultWriteBufferSize,
+		path:         "/",
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	httpsrv := &http.Server{
+		ReadHeaderTimeout: opts.loginwait,
+	}
+	if opts.httpConfig != nil {
+		opts.httpConfig(httpsrv)
+	}
+	httpsrv.Addr = listen
+	httpsrv.TLSConfig = opts.tlsConfig
 	return &Server{
 		listen:              listen,
 		ServiceRegistration: service,
-		options: ServerOptions{
-			loginwait: sun.DefaultLoginWait,
-			readwait:  sun.DefaultReadWait,
-			writewait: time.Second * 10,
-		},
+		options:             opts,
+		httpsrv:             httpsrv,
+		quit:                sun.NewEvent(),
 	}
 }
 
@@ -66,93 +252,238 @@ func (s *Server) Start() error {
 		s.ChannelMap = sun.NewChannels(100)
 	}
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// step 1
-		rawconn, _, _, err := ws.UpgradeHTTP(r, w)
+	mux.HandleFunc(s.options.path, func(w http.ResponseWriter, r *http.Request) {
+		// step 1 升级之前检查限制并校验请求，被拒绝的客户端不会占用一个升级后的连接
+		limiter := s.options.limiter
+		if err := limiter.CheckChannels(); err != nil {
+			resp(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err := limiter.BeginHandshake(); err != nil {
+			resp(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		handshaking := true
+		endHandshake := func() {
+			if handshaking {
+				handshaking = false
+				limiter.EndHandshake()
+			}
+		}
+		defer endHandshake()
+		if err := limiter.Allow(requestAddr(r.RemoteAddr)); err != nil {
+			resp(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if s.options.checkOrigin != nil && !s.options.checkOrigin(r) {
+			resp(w, http.StatusForbidden, "origin is not allowed")
+			return
+		}
+		if s.options.authenticate != nil {
+			if err := s.options.authenticate(r); err != nil {
+				resp(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+		var upgrader ws.HTTPUpgrader
+		var ext *wsflate.Extension
+		if s.options.compress {
+			ext = negotiateDeflate()
+			upgrader.Negotiate = ext.Negotiate
+		}
+		if len(s.options.protocols) > 0 {
+			upgrader.Protocol = s.supportProtocol
+		}
+		rawconn, _, hs, err := upgrader.Upgrade(r, w)
 		if err != nil {
 			resp(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
 		// step 2 包装conn
-		conn := NewConn(rawconn)
+		opts := ConnOptions{
+			MaxFrameSize:      s.options.maxFrameSize,
+			MaxMessageSize:    s.options.maxMsgSize,
+			FragmentSize:      s.options.fragmentSize,
+			WriteBufferSize:   s.options.writeBuffer,
+			CompressLevel:     s.options.compressLvl,
+			CompressThreshold: s.options.compressMin,
+		}
+		if ext != nil {
+			_, opts.Compress = ext.Accepted()
+		}
+		conn := NewConnWithOptions(rawconn, opts)
+		conn.req = r
+		conn.protocol = hs.Protocol
 
 		// step 3
-		id, err := s.Accept(conn, s.options.loginwait)
+		session, err := sun.AcceptWithin(s.Acceptor, conn, s.options.loginwait)
+		endHandshake()
 		if err != nil {
 			_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+			_ = conn.Flush()
+			conn.Close()
+			return
+		}
+		if err = limiter.AddChannel(); err != nil {
+			log.Warnf("channel %s rejected - %v", session.ChannelID, err)
+			_ = conn.WriteFrame(sun.OpClose, []byte(err.Error()))
+			_ = conn.Flush()
 			conn.Close()
 			return
 		}
-		if _, ok := s.Get(id); ok {
-			log.Warnf("channel %s existed", id)
-			_ = conn.WriteFrame(sun.OpClose, []byte("channelId is repeated"))
+		if !s.track() {
+			limiter.RemoveChannel()
+			_ = conn.WriteFrame(sun.OpClose, []byte(sun.CloseReasonShutdown))
+			_ = conn.Flush()
 			conn.Close()
 			return
 		}
 		// step 4
-		channel := sun.NewChannel(id, conn)
+		channel := sun.NewChannel(session.ChannelID, conn)
+		channel.SetSession(session)
 		channel.SetWriteWait(s.options.writewait)
 		channel.SetReadWait(s.options.readwait)
-		s.Add(channel)
+		old, err := sun.AddWithPolicy(s.ChannelMap, channel, s.options.duplicate, &s.replaced)
+		if err != nil {
+			log.Warnf("channel %s rejected - %v", session.ChannelID, err)
+			_ = channel.WriteFrame(sun.OpClose, []byte(err.Error()))
+			channel.Close()
+			limiter.RemoveChannel()
+			s.wg.Done()
+			return
+		}
+		if old != nil {
+			log.Infof("channel %s kicked by a new login", old.ID())
+			_ = s.Disconnect(old.Session())
+		}
 
 		go func(ch sun.Channel) {
+			defer s.wg.Done()
 			// step 5
 			err := ch.Readloop(s.MessageListener)
 			if err != nil {
 				log.Info(err)
 			}
-			// step 6
-			s.Remove(ch.ID())
-			err = s.Disconnect(ch.ID())
-			if err != nil {
-				log.Warn(err)
+			// step 6 被踢掉的连接不会再次回调Disconnect
+			limiter.RemoveChannel()
+			if s.replaced.Logout(s.ChannelMap, ch) {
+				err = s.Disconnect(ch.Session())
+				if err != nil {
+					log.Warn(err)
+				}
 			}
 			ch.Close()
 		}(channel)
 
 	})
+	for _, h := range s.options.handlers {
+		mux.Handle(h.pattern, h.handler)
+	}
+	s.httpsrv.Handler = mux
+
+	lst, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	lst = proxyproto.NewListener(lst, s.options.proxyMode, s.options.loginwait)
+
 	log.Infoln("started")
-	return http.ListenAndServe(s.listen, mux)
+	if s.options.tlsConfig != nil {
+		err = s.httpsrv.ServeTLS(lst, "", "")
+	} else {
+		err = s.httpsrv.Serve(lst)
+	}
+	// 调用Shutdown之后正常退出
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// track 记录一个新的连接协程，Shutdown之后返回false
+func (s *Server) track() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.quit.HasFired() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
 }
 
-// Shutdown Shutdown
+// Shutdown 停止监听，通知所有连接服务下线，并在ctx到期之前写完队列中的消息，
+// 返回时每个Channel都已经回调了StateListener.Disconnect
 func (s *Server) Shutdown(ctx context.Context) error {
 	log := logger.WithFields(logger.Fields{
 		"module": "ws.server",
 		"id":     s.ServiceID(),
 	})
+	var err error
 	s.once.Do(func() {
 		defer func() {
 			log.Infoln("shutdown")
 		}()
-		// close channels
-		chanels := s.ChannelMap.All()
-		for _, ch := range chanels {
-			ch.Close()
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
-			}
+		s.lock.Lock()
+		s.quit.Fire()
+		s.lock.Unlock()
+		// 停止监听，不再接收新的连接；已升级的连接被hijack，不受影响
+		err = s.httpsrv.Shutdown(ctx)
+		if s.ChannelMap == nil {
+			return
+		}
+		sun.ShutdownChannels(ctx, s.ChannelMap, sun.CloseReasonShutdown)
+		s.replaced.Shutdown(ctx, sun.CloseReasonShutdown)
+		// 等待连接协程执行完Disconnect
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
-
 	})
-	return nil
+	return err
 }
 
-// string channelID
+// Push string channelID
 // []byte data
 func (s *Server) Push(id string, data []byte) error {
 	ch, ok := s.ChannelMap.Get(id)
 	if !ok {
-		return errors.New("channel no found")
+		return sun.ErrChannelNotFound
 	}
 	return ch.Push(data)
 }
 
+// Redirect 通知连接迁移到其它节点
+func (s *Server) Redirect(targets []string, window time.Duration, ids ...string) (int, error) {
+	return sun.RedirectChannels(s.ChannelMap, targets, window, ids...)
+}
+
+// PushToUser 推送消息到用户所有满足filters的在线设备
+func (s *Server) PushToUser(userID string, payload []byte, filters ...sun.DeviceFilter) (int, error) {
+	return sun.PushToUser(s.ChannelMap, userID, payload, filters...)
+}
+
+// Kick 踢掉用户所有满足filters的在线设备
+func (s *Server) Kick(userID string, reason string, filters ...sun.DeviceFilter) int {
+	return sun.KickUser(s.ChannelMap, userID, reason, filters...)
+}
+
+// Broadcast 推送消息到所有满足filters的连接
+func (s *Server) Broadcast(payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.BroadcastChannels(s.ChannelMap, payload, s.options.pushWorkers, filters...)
+}
+
+// PushMany 推送消息到ids中满足filters的连接
+func (s *Server) PushMany(ids []string, payload []byte, filters ...sun.DeviceFilter) *sun.PushReport {
+	return sun.PushChannels(s.ChannelMap, ids, payload, s.options.pushWorkers, filters...)
+}
+
 // SetAcceptor SetAcceptor
 func (s *Server) SetAcceptor(acceptor sun.Acceptor) {
 	s.Acceptor = acceptor
@@ -178,6 +509,22 @@ func (s *Server) SetReadWait(readwait time.Duration) {
 	s.options.readwait = readwait
 }
 
+func (s *Server) supportProtocol(protocol string) bool {
+	for _, p := range s.options.protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAddr 把http.Request.RemoteAddr包装成net.Addr
+type requestAddr string
+
+func (a requestAddr) Network() string { return "tcp" }
+
+func (a requestAddr) String() string { return string(a) }
+
 func resp(w http.ResponseWriter, code int, body string) {
 	w.WriteHeader(code)
 	if body != "" {
@@ -190,6 +537,6 @@ type defaultAcceptor struct {
 }
 
 // Accept defaultAcceptor
-func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (string, error) {
-	return ksuid.New().String(), nil
+func (a *defaultAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	return &sun.Session{ChannelID: ksuid.New().String()}, nil
 }
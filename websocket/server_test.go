@@ -0,0 +1,342 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	sun "github.com/sunrnalike/sun"
+	"github.com/sunrnalike/sun/naming"
+	"github.com/sunrnalike/sun/proxyproto"
+)
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func freePort(t *testing.T) string {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	_, port, _ := net.SplitHostPort(lst.Addr().String())
+	return port
+}
+
+type echoListener struct{}
+
+func (l *echoListener) Receive(ag sun.Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func (l *echoListener) Disconnect(session *sun.Session) error { return nil }
+
+type wsDialer struct{}
+
+func (d *wsDialer) DialAndHandshake(ctx sun.DialerContext) (net.Conn, error) {
+	return Dial(context.Background(), ctx.Address, DialOptions{TLSConfig: ctx.TLSConfig})
+}
+
+func TestServerWithTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	port := freePort(t)
+	srv := NewServer("127.0.0.1:"+port, &naming.DefaultService{Id: "srv1"},
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithPath("/ws"),
+		WithHandler("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})),
+		WithHTTPServer(func(hs *http.Server) {
+			hs.IdleTimeout = time.Second
+		}),
+	)
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	exited := make(chan error, 1)
+	go func() {
+		exited <- srv.Start()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	// 同一个端口上的http处理器
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := hc.Get("https://localhost:" + port + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("unexpected health response %s", body)
+	}
+
+	cli := NewClient("c1", "client", ClientOptions{TLSConfig: &tls.Config{RootCAs: pool}})
+	cli.SetDialer(&wsDialer{})
+	if err := cli.Connect("wss://localhost:" + port + "/ws"); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cli.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.GetPayload()) != "hello" {
+		t.Fatalf("unexpected payload %s", frame.GetPayload())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start does not return after Shutdown")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+		t.Fatal("listener should be closed after Shutdown")
+	}
+}
+
+func TestServerWithProxyProtocol(t *testing.T) {
+	port := freePort(t)
+	srv := NewServer("127.0.0.1:"+port, &naming.DefaultService{Id: "srv1"},
+		WithProxyProtocol(proxyproto.ModeRequired),
+		WithHandler("/addr", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		})),
+	)
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 8000\r\n"))
+	_, _ = conn.Write([]byte("GET /addr HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	resp, _ := io.ReadAll(conn)
+	if !strings.HasSuffix(string(resp), "1.2.3.4:5678") {
+		t.Fatalf("unexpected response %s", resp)
+	}
+}
+
+type requestAcceptor struct {
+	protocol chan string
+}
+
+// Accept 使用升级请求中的user作为channelId，不需要读取鉴权帧
+func (a *requestAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	r, ok := Request(conn)
+	if !ok {
+		return nil, errors.New("no upgrade request")
+	}
+	a.protocol <- Subprotocol(conn)
+	return &sun.Session{ChannelID: r.URL.Query().Get("user")}, nil
+}
+
+func TestUpgradeAuthentication(t *testing.T) {
+	port := freePort(t)
+	acceptor := &requestAcceptor{protocol: make(chan string, 1)}
+	srv := NewServer("127.0.0.1:"+port, &naming.DefaultService{Id: "srv1"},
+		WithAuthenticator(func(r *http.Request) error {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				return errors.New("invalid token")
+			}
+			return nil
+		}),
+		WithCheckOrigin(func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || origin == "https://im.example.com"
+		}),
+		WithSubprotocols("sun.v2", "sun.v1"),
+	)
+	srv.SetAcceptor(acceptor)
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+	address := "ws://localhost:" + port + "/?user=u1"
+
+	// 升级之前拒绝
+	_, err := Dial(context.Background(), address, DialOptions{})
+	if status, ok := err.(ws.StatusError); !ok || int(status) != http.StatusUnauthorized {
+		t.Fatalf("got %v, want 401", err)
+	}
+	header := http.Header{"Authorization": []string{"Bearer secret"}, "Origin": []string{"https://evil.com"}}
+	_, err = Dial(context.Background(), address, DialOptions{Header: header})
+	if status, ok := err.(ws.StatusError); !ok || int(status) != http.StatusForbidden {
+		t.Fatalf("got %v, want 403", err)
+	}
+
+	header.Del("Origin")
+	conn, err := Dial(context.Background(), address, DialOptions{Header: header, Protocols: []string{"sun.v3", "sun.v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protocol := <-acceptor.protocol; protocol != "sun.v1" {
+		t.Fatalf("negotiated %q, want sun.v1", protocol)
+	}
+	if err = wsutil.WriteClientBinary(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := wsutil.ReadServerBinary(conn)
+	if err != nil || string(payload) != "hello" {
+		t.Fatal(string(payload), err)
+	}
+}
+
+// frameAcceptor 读取一个鉴权帧，payload就是channelId
+type frameAcceptor struct{}
+
+func (a *frameAcceptor) Accept(conn sun.Conn, timeout time.Duration) (*sun.Session, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return &sun.Session{ChannelID: string(frame.GetPayload())}, nil
+}
+
+func TestLoginTimeout(t *testing.T) {
+	port := freePort(t)
+	srv := NewServer("127.0.0.1:"+port, &naming.DefaultService{Id: "srv1"}, WithLoginWait(time.Millisecond*200))
+	srv.SetAcceptor(&frameAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+
+	// 升级之后不发送鉴权帧
+	conn, err := Dial(context.Background(), "ws://localhost:"+port+"/", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := ws.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("unexpected opcode %v", frame.Header.OpCode)
+	}
+	if string(frame.Payload) != sun.ErrLoginTimeout.Error() {
+		t.Fatalf("unexpected reason %q", frame.Payload)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	port := freePort(t)
+	limiter := sun.NewLimiter(sun.Limits{MaxChannels: 1, IPRate: 0.001, IPBurst: 2})
+	srv := NewServer("127.0.0.1:"+port, &naming.DefaultService{Id: "srv1"}, WithLimiter(limiter))
+	srv.SetAcceptor(&frameAcceptor{})
+	srv.SetMessageListener(&echoListener{})
+	srv.SetStateListener(&echoListener{})
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(time.Millisecond * 100)
+	address := "ws://localhost:" + port + "/"
+
+	login := func(id string) net.Conn {
+		conn, err := Dial(context.Background(), address, DialOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = wsutil.WriteClientBinary(conn, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	waitChannels := func(n int64) {
+		for i := 0; i < 100 && limiter.Stats().Channels != n; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if got := limiter.Stats().Channels; got != n {
+			t.Fatalf("%d channels, want %d", got, n)
+		}
+	}
+	expectStatus := func(code int) {
+		_, err := Dial(context.Background(), address, DialOptions{})
+		if status, ok := err.(ws.StatusError); !ok || int(status) != code {
+			t.Fatalf("got %v, want %d", err, code)
+		}
+	}
+
+	conn := login("u1")
+	waitChannels(1)
+	// 连接数已满，升级之前返回503，不消耗速率令牌
+	expectStatus(http.StatusServiceUnavailable)
+	conn.Close()
+	waitChannels(0)
+
+	conn = login("u2")
+	waitChannels(1)
+	conn.Close()
+	waitChannels(0)
+	// 两个令牌已经用完
+	expectStatus(http.StatusTooManyRequests)
+	if stats := limiter.Stats(); stats.RejectedChannels != 1 || stats.RejectedRate != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -6,6 +6,7 @@ package endian
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
@@ -70,6 +71,27 @@ func ReadBytes(r io.Reader) ([]byte, error) {
 	return buf, nil
 }
 
+// ErrBytesTooLong 长度前缀超过了允许的最大长度
+var ErrBytesTooLong = errors.New("endian: bytes length exceeds limit")
+
+// ReadBytesLimit 与ReadBytes相同，长度前缀超过limit时返回ErrBytesTooLong，
+// 读取不可信的数据时不会按照其中的长度分配内存
+func ReadBytesLimit(r io.Reader, limit int) ([]byte, error) {
+	bufLen, err := ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(bufLen) > int64(limit) {
+		return nil, ErrBytesTooLong
+	}
+	buf := make([]byte, bufLen)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 //ReadFixedBytes 读取固定长度的字节
 func ReadFixedBytes(len int, r io.Reader) ([]byte, error) {
 	buf := make([]byte, len)
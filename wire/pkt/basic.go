@@ -0,0 +1,100 @@
+package pkt
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/sunrnalike/sun/wire"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+// basic pkt code
+const (
+	CodePing = uint16(1)
+	CodePong = uint16(2)
+	// CodeRedirect 迁移通知，Body是一个编码后的Redirect
+	CodeRedirect = uint16(3)
+)
+
+// BasicPkt 基础消息包，用于心跳等不需要经过逻辑服务的场景
+type BasicPkt struct {
+	Code   uint16
+	Length uint16
+	Body   []byte
+}
+
+// Decode Decode
+func (p *BasicPkt) Decode(r io.Reader) error {
+	var err error
+	if p.Code, err = endian.ReadUint16(r); err != nil {
+		return err
+	}
+	if p.Length, err = endian.ReadUint16(r); err != nil {
+		return err
+	}
+	if p.Length > 0 {
+		if p.Body, err = endian.ReadFixedBytes(int(p.Length), r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode Encode
+func (p *BasicPkt) Encode(w io.Writer) error {
+	if err := endian.WriteUint16(w, p.Code); err != nil {
+		return err
+	}
+	if err := endian.WriteUint16(w, p.Length); err != nil {
+		return err
+	}
+	if p.Length > 0 {
+		if _, err := w.Write(p.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redirect 迁移通知，服务端要求客户端在Window之内随机选择一个时间点重连到Address
+type Redirect struct {
+	Address string
+	Window  time.Duration
+}
+
+// NewRedirectPkt 创建一个迁移通知，Window精确到毫秒
+func NewRedirectPkt(address string, window time.Duration) *BasicPkt {
+	buf := new(bytes.Buffer)
+	_ = endian.WriteShortBytes(buf, []byte(address))
+	_ = endian.WriteUint32(buf, uint32(window/time.Millisecond))
+	return &BasicPkt{
+		Code:   CodeRedirect,
+		Length: uint16(buf.Len()),
+		Body:   buf.Bytes(),
+	}
+}
+
+// ReadRedirect 从一个帧的payload中解析迁移通知，payload不是迁移通知时返回false
+func ReadRedirect(payload []byte) (*Redirect, bool) {
+	if !bytes.HasPrefix(payload, wire.MagicBasicPkt[:]) {
+		return nil, false
+	}
+	basic, err := MustReadBasicPkt(bytes.NewReader(payload))
+	if err != nil || basic.Code != CodeRedirect {
+		return nil, false
+	}
+	r := bytes.NewReader(basic.Body)
+	address, err := endian.ReadShortString(r)
+	if err != nil {
+		return nil, false
+	}
+	window, err := endian.ReadUint32(r)
+	if err != nil {
+		return nil, false
+	}
+	return &Redirect{
+		Address: address,
+		Window:  time.Duration(window) * time.Millisecond,
+	}, true
+}
@@ -0,0 +1,177 @@
+package pkt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sunrnalike/sun/wire"
+	"github.com/sunrnalike/sun/wire/endian"
+	"google.golang.org/protobuf/proto"
+)
+
+// LogicPkt 定义了网关对外的client消息结构
+type LogicPkt struct {
+	Header
+	Body []byte `json:"body,omitempty"`
+}
+
+// HeaderOption HeaderOption
+type HeaderOption func(*Header)
+
+// WithStatus WithStatus
+func WithStatus(status Status) HeaderOption {
+	return func(h *Header) {
+		h.Status = status
+	}
+}
+
+// WithSeq WithSeq
+func WithSeq(seq uint32) HeaderOption {
+	return func(h *Header) {
+		h.Sequence = seq
+	}
+}
+
+// WithChannel set channelID
+func WithChannel(channelID string) HeaderOption {
+	return func(h *Header) {
+		h.ChannelId = channelID
+	}
+}
+
+// WithDest WithDest
+func WithDest(dest string) HeaderOption {
+	return func(h *Header) {
+		h.Dest = dest
+	}
+}
+
+// WithFlag WithFlag
+func WithFlag(flag Flag) HeaderOption {
+	return func(h *Header) {
+		h.Flag = flag
+	}
+}
+
+// New new a empty payload message
+func New(command string, options ...HeaderOption) *LogicPkt {
+	pkt := &LogicPkt{}
+	pkt.Command = command
+
+	for _, option := range options {
+		option(&pkt.Header)
+	}
+	if pkt.Sequence == 0 {
+		pkt.Sequence = wire.Seq.Next()
+	}
+	return pkt
+}
+
+// NewFrom new a response packet from a request header
+func NewFrom(header *Header) *LogicPkt {
+	pkt := &LogicPkt{}
+	pkt.Header = Header{
+		Command:   header.Command,
+		Sequence:  header.Sequence,
+		ChannelId: header.ChannelId,
+		Flag:      Flag_Response,
+		Status:    header.Status,
+		Dest:      header.Dest,
+	}
+	return pkt
+}
+
+// MaxPacketSize Decode时header与body的最大长度，与sun.DefaultMaxFrameSize一致
+const MaxPacketSize = 1024 * 1024
+
+// limitOf r能够返回剩余长度时(如bytes.Reader)，长度前缀不能超过剩余的字节数
+func limitOf(r io.Reader) int {
+	if lr, ok := r.(interface{ Len() int }); ok && lr.Len() < MaxPacketSize {
+		return lr.Len()
+	}
+	return MaxPacketSize
+}
+
+// Decode read bytes of LogicPkt from a reader
+func (p *LogicPkt) Decode(r io.Reader) error {
+	headerBytes, err := endian.ReadBytesLimit(r, limitOf(r))
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(headerBytes, &p.Header); err != nil {
+		return err
+	}
+	// read body
+	p.Body, err = endian.ReadBytesLimit(r, limitOf(r))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode Header to writer
+func (p *LogicPkt) Encode(w io.Writer) error {
+	headerBytes, err := proto.Marshal(&p.Header)
+	if err != nil {
+		return err
+	}
+	if err := endian.WriteBytes(w, headerBytes); err != nil {
+		return err
+	}
+	if err := endian.WriteBytes(w, p.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadBody val must be a pointer
+func (p *LogicPkt) ReadBody(val proto.Message) error {
+	return proto.Unmarshal(p.Body, val)
+}
+
+// WriteBody WriteBody
+func (p *LogicPkt) WriteBody(val proto.Message) *LogicPkt {
+	if val == nil {
+		return p
+	}
+	p.Body, _ = proto.Marshal(val)
+	return p
+}
+
+// StringBody return string body
+func (p *LogicPkt) StringBody() string {
+	return string(p.Body)
+}
+
+func (p *LogicPkt) String() string {
+	return fmt.Sprintf("header:%v body:%dbits", &p.Header, len(p.Body))
+}
+
+// ServiceName 从command中解析出服务名，如 login.signin 返回 login
+func (h *Header) ServiceName() string {
+	arr := strings.SplitN(h.Command, ".", 2)
+	if len(arr) <= 1 {
+		return "default"
+	}
+	return arr[0]
+}
+
+// AddMeta AddMeta
+func (p *LogicPkt) AddMeta(key, value string) {
+	if p.Meta == nil {
+		p.Meta = make(map[string]string)
+	}
+	p.Meta[key] = value
+}
+
+// GetMeta GetMeta
+func (p *LogicPkt) GetMeta(key string) (string, bool) {
+	val, ok := p.Meta[key]
+	return val, ok
+}
+
+// DelMeta DelMeta
+func (p *LogicPkt) DelMeta(key string) {
+	delete(p.Meta, key)
+}
@@ -0,0 +1,77 @@
+package pkt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/sunrnalike/sun/wire"
+)
+
+// Packet messages
+type Packet interface {
+	Decode(r io.Reader) error
+	Encode(w io.Writer) error
+}
+
+// Read 根据魔数读取一个消息包，返回 *LogicPkt 或 *BasicPkt
+func Read(r io.Reader) (interface{}, error) {
+	magic := wire.Magic{}
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil {
+		return nil, err
+	}
+	switch magic {
+	case wire.MagicLogicPkt:
+		p := new(LogicPkt)
+		if err := p.Decode(r); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case wire.MagicBasicPkt:
+		p := new(BasicPkt)
+		if err := p.Decode(r); err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("magic code %v is incorrect", magic)
+	}
+}
+
+// MustReadLogicPkt only read LogicPkt
+func MustReadLogicPkt(r io.Reader) (*LogicPkt, error) {
+	val, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if lp, ok := val.(*LogicPkt); ok {
+		return lp, nil
+	}
+	return nil, fmt.Errorf("packet is not a logic packet")
+}
+
+// MustReadBasicPkt only read BasicPkt
+func MustReadBasicPkt(r io.Reader) (*BasicPkt, error) {
+	val, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if bp, ok := val.(*BasicPkt); ok {
+		return bp, nil
+	}
+	return nil, fmt.Errorf("packet is not a basic packet")
+}
+
+// Marshal 序列化消息包，并在头部写入对应的魔数
+func Marshal(p Packet) []byte {
+	buf := new(bytes.Buffer)
+	switch p.(type) {
+	case *LogicPkt:
+		_, _ = buf.Write(wire.MagicLogicPkt[:])
+	case *BasicPkt:
+		_, _ = buf.Write(wire.MagicBasicPkt[:])
+	}
+	_ = p.Encode(buf)
+	return buf.Bytes()
+}
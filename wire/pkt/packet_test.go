@@ -0,0 +1,97 @@
+package pkt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sunrnalike/sun/wire"
+	"github.com/sunrnalike/sun/wire/endian"
+)
+
+func TestLogicPktMarshal(t *testing.T) {
+	req := New(wire.CommandChatUserTalk, WithChannel("ch1"), WithDest("u2"))
+	req.Body = []byte("hello")
+	req.AddMeta(wire.MetaDestServer, "gateway01")
+
+	p, err := Read(bytes.NewReader(Marshal(req)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp, ok := p.(*LogicPkt)
+	if !ok {
+		t.Fatalf("expect *LogicPkt, got %T", p)
+	}
+	if lp.Command != wire.CommandChatUserTalk || lp.ChannelId != "ch1" || lp.Dest != "u2" {
+		t.Fatalf("unexpected header %v", &lp.Header)
+	}
+	if lp.Sequence != req.Sequence {
+		t.Fatalf("sequence %d != %d", lp.Sequence, req.Sequence)
+	}
+	if val, _ := lp.GetMeta(wire.MetaDestServer); val != "gateway01" {
+		t.Fatalf("unexpected meta %v", lp.Meta)
+	}
+	if lp.StringBody() != "hello" {
+		t.Fatalf("unexpected body %s", lp.Body)
+	}
+	if lp.ServiceName() != "chat" {
+		t.Fatalf("unexpected service name %s", lp.ServiceName())
+	}
+}
+
+func TestBasicPktMarshal(t *testing.T) {
+	ping := &BasicPkt{Code: CodePing}
+	bp, err := MustReadBasicPkt(bytes.NewReader(Marshal(ping)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.Code != CodePing || len(bp.Body) != 0 {
+		t.Fatalf("unexpected basic packet %v", bp)
+	}
+
+	_, err = MustReadLogicPkt(bytes.NewReader(Marshal(ping)))
+	if err == nil {
+		t.Fatal("expect an error when reading a basic packet as logic packet")
+	}
+}
+
+func TestRedirectPkt(t *testing.T) {
+	payload := Marshal(NewRedirectPkt("ws://10.0.0.2:8000", time.Second*30))
+	r, ok := ReadRedirect(payload)
+	if !ok {
+		t.Fatal("expect a redirect packet")
+	}
+	if r.Address != "ws://10.0.0.2:8000" || r.Window != time.Second*30 {
+		t.Fatalf("unexpected redirect %v", r)
+	}
+	if _, ok = ReadRedirect(Marshal(&BasicPkt{Code: CodePing})); ok {
+		t.Fatal("ping is not a redirect packet")
+	}
+	if _, ok = ReadRedirect([]byte("hello")); ok {
+		t.Fatal("hello is not a redirect packet")
+	}
+}
+
+func TestReadBadMagic(t *testing.T) {
+	_, err := Read(bytes.NewReader([]byte("hello world")))
+	if err == nil {
+		t.Fatal("expect an error with incorrect magic")
+	}
+}
+
+func TestLogicPktLengthOverflow(t *testing.T) {
+	// 魔数之后的长度前缀声明了4GiB的header，实际只有几个字节
+	buf := new(bytes.Buffer)
+	buf.Write(wire.MagicLogicPkt[:])
+	_ = endian.WriteUint32(buf, 0xffffffff)
+	buf.Write([]byte("fake"))
+
+	if _, err := MustReadLogicPkt(bytes.NewReader(buf.Bytes())); err != endian.ErrBytesTooLong {
+		t.Fatalf("got %v, want ErrBytesTooLong", err)
+	}
+	// 不能获取剩余长度的reader按MaxPacketSize限制
+	if _, err := MustReadLogicPkt(io.MultiReader(bytes.NewReader(buf.Bytes()))); err != endian.ErrBytesTooLong {
+		t.Fatalf("got %v, want ErrBytesTooLong", err)
+	}
+}
@@ -0,0 +1,25 @@
+package wire
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+type sequence struct {
+	num uint32
+}
+
+// Next 返回下一个序列号，溢出后从1重新开始
+func (s *sequence) Next() uint32 {
+	next := atomic.AddUint32(&s.num, 1)
+	if next == math.MaxUint32 {
+		if atomic.CompareAndSwapUint32(&s.num, next, 1) {
+			return 1
+		}
+		return s.Next()
+	}
+	return next
+}
+
+// Seq 全局的消息序列号生成器
+var Seq = sequence{num: 1}
@@ -0,0 +1,30 @@
+package wire
+
+// Command defined data type between client and server
+const (
+	// login
+	CommandLoginSignIn  = "login.signin"
+	CommandLoginSignOut = "login.signout"
+
+	// chat
+	CommandChatUserTalk  = "chat.user.talk"
+	CommandChatGroupTalk = "chat.group.talk"
+	CommandChatTalkAck   = "chat.talk.ack"
+)
+
+// Meta Key of a packet
+const (
+	// 消息将要送达的网关的ServiceName
+	MetaDestServer = "dest.server"
+	// 消息将要送达的channels
+	MetaDestChannels = "dest.channels"
+)
+
+// Magic 用于区分不同类型的消息包
+type Magic [4]byte
+
+// 消息包的魔数
+var (
+	MagicLogicPkt = Magic{0xc3, 0x11, 0xa3, 0x65}
+	MagicBasicPkt = Magic{0xc3, 0x15, 0xa7, 0x65}
+)